@@ -3,129 +3,342 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"time"
 
 	"github.com/namsral/flag"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/csiclient"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/logging"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/metrics"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/store/etcd"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/store/file"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/tracing"
 )
 
 var (
-	// CSI variables
-	csiEndpoint       = flag.String("csi-endpoint", "unix:///csi/csi.sock", "CSI endpoint to connect to")
-	csiTlsCert        = flag.String("csi-tls-cert", "", "CSI TLS Client Certificate")
-	csiTlsKey         = flag.String("csi-tls-key", "", "CSI TLS Client Private key")
-	csiTlsCA          = flag.String("csi-tls-ca", "", "CSI TLS Certificate Authority")
-	operation         = flag.String("operation", "", "Operation to perform: create|attach|detach|remove|grow|setinfo|verify")
-	etcdStoreEndpoint = flag.String("etcd-store-endpoint", "localhost:2379", "Etcd endpoint for etcd store")
+	configFile = flag.String("config-file", "", "Configuration file (YAML), settings below override it")
+	operation  = flag.String("operation", "", "Operation to perform: create|attach|detach|remove|grow|setinfo|verify|open|close|gc|invalidate-cache")
+	gcConfirm  = flag.Bool("gc-confirm", false, "Make gc clean up stale attachments, instead of only reporting them")
+
+	// CSI variables, applied to the default driver
+	csiEndpoint = flag.String("csi-endpoint", config.DefaultEndpoint, "CSI endpoint to connect to")
+	csiTlsCert  = flag.String("csi-tls-cert", "", "CSI TLS Client Certificate")
+	csiTlsKey   = flag.String("csi-tls-key", "", "CSI TLS Client Private key")
+	csiTlsCA    = flag.String("csi-tls-ca", "", "CSI TLS Certificate Authority")
+
+	csiTlsMode       = flag.String("csi-tls-mode", "", "CSI TLS mode: disabled|ca|verify, derived from other TLS settings by default")
+	csiTlsServerName = flag.String("csi-tls-server-name", "", "CSI TLS server name to verify, instead of the endpoint host")
+	csiTlsPinSHA256  = flag.String("csi-tls-pin-sha256", "", "CSI TLS server certificate SHA-256 fingerprint to pin")
+
+	csiControllerEndpoint = flag.String("csi-controller-endpoint", "", "CSI controller service endpoint, if different from csi-endpoint")
+	csiNodeEndpoint       = flag.String("csi-node-endpoint", "", "CSI node service endpoint, if different from csi-endpoint")
+
+	csiReadyTimeout   = flag.Duration("csi-ready-timeout", config.DefaultReadyTimeout, "Timeout of waiting for a CSI service socket to appear and Probe to report ready")
+	csiConnectTimeout = flag.Duration("csi-connect-timeout", config.DefaultConnectTimeout, "Timeout of connecting to a CSI service and discovering it")
+	csiDeviceTimeout  = flag.Duration("csi-device-timeout", config.DefaultDeviceTimeout, "Timeout of waiting for a published device to appear")
+	csiSettle         = flag.Bool("csi-settle", false, "Wait for udev to settle before validating published devices")
+	operationTimeout  = flag.Duration("operation-timeout", config.DefaultOperationTimeout, "Timeout of operations without a timeout of their own")
+
+	cacheDir          = flag.String("cache-dir", config.DefaultCacheDir, "Directory for caching CSI capabilities, empty disables caching")
+	cacheTTL          = flag.Duration("cache-ttl", config.DefaultCacheTTL, "Maximum age of cached CSI capabilities")
+	attachDir         = flag.String("attach-dir", config.DefaultAttachDir, "Base directory of volumes attached on the node")
+	provider          = flag.String("provider", "", "Extstorage provider name, volumes are attached in its subdirectory of attach-dir")
+	etcdStoreEndpoint = flag.String("etcd-store-endpoint", config.DefaultEtcdEndpoint, "Etcd endpoint for etcd store")
 	etcdTlsCert       = flag.String("etcd-tls-cert", "", "Etcd TLS Client Certificate")
 	etcdTlsKey        = flag.String("etcd-tls-key", "", "Etcd TLS Client Private key")
 	etcdTlsCA         = flag.String("etcd-tls-ca", "", "Etcd TLS Certificate Authority")
+	etcdTlsMode       = flag.String("etcd-tls-mode", "", "Etcd TLS mode: disabled|ca|verify, derived from other TLS settings by default")
+	etcdTlsServerName = flag.String("etcd-tls-server-name", "", "Etcd TLS server name to verify, instead of the endpoint host")
+	etcdTlsPinSHA256  = flag.String("etcd-tls-pin-sha256", "", "Etcd TLS server certificate SHA-256 fingerprint to pin")
 	fileStoreBase     = flag.String("file-store-base", "", "File store base directory, for development")
+
+	logFormat = flag.String("log-format", config.LogFormatText, "Log format: text|json|syslog")
+	logLevel  = flag.String("log-level", config.DefaultLogLevel, "Log level: debug|info|warn|error")
+
+	metricsTextfile = flag.String("metrics-textfile", "", "Prometheus textfile collector file (*.prom) updated by each run, empty disables metrics")
+
+	tracingExporter = flag.String("tracing-exporter", "", "OpenTelemetry trace exporter: otlp|file, empty disables tracing")
+	tracingEndpoint = flag.String("tracing-endpoint", config.DefaultTracingEndpoint, "OTLP gRPC endpoint of the collector")
+	tracingFile     = flag.String("tracing-file", "", "File spans are appended to by the file exporter")
+)
+
+const (
+	// tracingFlushTimeout limits exporting spans at exit
+	tracingFlushTimeout = 5 * time.Second
+
+	// exitTimeout is the exit status when the storage timed out, as of
+	// timeout(1)
+	exitTimeout = 124
 )
 
 func main() {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancel()
-	var st store.Store
 	var err error
-	var tlsConfig *tls.Config
 
 	flag.Parse()
 
-	if *fileStoreBase != "" {
-		st, err = file.New(*fileStoreBase)
+	cfg := config.Default()
+	if *configFile != "" {
+		if cfg, err = config.Load(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	applyFlags(cfg)
+	if err = cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	logger, err := logging.New(cfg.Log)
+	if err != nil {
+		log.Fatalf("Error setting up logging: %v", err)
+	}
+	slog.SetDefault(logger.With("operation", *operation, "correlation_id", logging.CorrelationID()))
+
+	cache := &csiclient.CapabilityCache{
+		Dir: *cfg.Cache.Dir,
+		TTL: cfg.Cache.TTL,
+	}
+
+	if *operation == "invalidate-cache" {
+		if err = cache.Invalidate(); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	// telemetry must not fail storage operations
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		slog.Warn("failed setting up tracing, tracing disabled", "error", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
+	start := time.Now()
+	slog.Info("operation started")
+
+	ctx, span := tracing.Start(context.Background(), *operation)
+	err = run(ctx, cfg, cache)
+	tracing.End(span, err)
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+	if terr := shutdownTracing(flushCtx); terr != nil {
+		slog.Warn("failed exporting traces", "error", terr)
+	}
+	cancel()
+
+	result := metrics.ResultOK
+	switch {
+	case isTimeout(err):
+		result = metrics.ResultTimeout
+	case err != nil:
+		result = metrics.ResultError
+	}
+	metrics.ObserveOperation(*operation, result, time.Since(start))
+	if merr := metrics.Flush(cfg.Metrics.Textfile); merr != nil {
+		slog.Warn("failed writing metrics", "error", merr)
+	}
+
+	if result == metrics.ResultTimeout {
+		slog.Error("storage timed out", "error", err)
+		os.Exit(exitTimeout)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	slog.Info("operation finished", "duration", time.Since(start))
+}
+
+// run performs the operation on the volume given in the environment, within
+// its timeout
+func run(ctx context.Context, cfg *config.Config, cache *csiclient.CapabilityCache) error {
+	timeout := cfg.OperationTimeout(*operation)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := operate(ctx, cfg, cache)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s exceeded its timeout of %s: %w", *operation, timeout, err)
+	}
+
+	return err
+}
+
+// operate connects to the store and the CSI driver, and performs the
+// operation
+func operate(ctx context.Context, cfg *config.Config, cache *csiclient.CapabilityCache) error {
+	var st store.Store
+	var err error
+
+	if cfg.Store.File.Base != "" {
+		st, err = file.New(cfg.Store.File.Base)
 	} else {
-		tlsConfig, err = prepareTlsConfig(*etcdTlsCert, *etcdTlsKey, *etcdTlsCA)
+		var tlsConfig *tls.Config
+		tlsConfig, err = cfg.Store.Etcd.TLS.Config()
 		if err != nil {
-			log.Fatalf("Error preparing tls configuration for etcd: %+v", err)
+			return fmt.Errorf("preparing tls configuration for etcd: %w", err)
 		}
-		st, err = etcd.New(*etcdStoreEndpoint, tlsConfig)
+		st, err = etcd.New(cfg.Store.Etcd.Endpoint, tlsConfig)
 	}
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	// retries are outermost, so each attempt is logged
+	st = store.WithRetry(store.WithLogging(st, storeKind(cfg)), &cfg.Retry)
 	defer st.Close(ctx)
 
-	tlsConfig, err = prepareTlsConfig(*csiTlsCert, *csiTlsKey, *csiTlsCA)
-	if err != nil {
-		log.Fatalf("Error preparing tls configuration for csi: %+v", err)
+	if *operation == "gc" {
+		return csiclient.GC(ctx, cfg, st, cache, *gcConfirm)
 	}
 
 	volConfig := extstorage.ParseVolumeInfo()
+	slog.SetDefault(slog.Default().With("vol_uuid", volConfig.UUID, "vol_name", volConfig.Name))
+	trace.SpanFromContext(ctx).SetAttributes(
+		tracing.VolumeUUID.String(volConfig.UUID),
+		tracing.VolumeName.String(volConfig.Name),
+	)
 
-	client, err := csiclient.New(*csiEndpoint, tlsConfig, st)
+	client, err := csiclient.New(cfg, st, cache)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer client.Close(ctx)
 
 	switch *operation {
 	case "create":
-		err = client.Create(ctx, volConfig)
+		return client.Create(ctx, volConfig)
 	case "attach":
-		err = client.Attach(ctx, volConfig)
+		return client.Attach(ctx, volConfig)
 	case "detach":
-		err = client.Detach(ctx, volConfig)
+		return client.Detach(ctx, volConfig)
 	case "remove":
-		err = client.Remove(ctx, volConfig)
+		return client.Remove(ctx, volConfig)
 	case "grow":
-		err = client.Grow(ctx, volConfig)
+		return client.Grow(ctx, volConfig)
 	case "setinfo":
-		err = client.Setinfo(ctx, volConfig)
+		return client.Setinfo(ctx, volConfig)
 	case "verify":
-		err = client.Verify(ctx, volConfig)
-	default:
-		err = errors.New("Invalid command")
+		return client.Verify(ctx, volConfig)
+	case "open":
+		return client.Open(ctx, volConfig)
+	case "close":
+		return client.CloseVolume(ctx, volConfig)
 	}
 
-	if err != nil {
-		log.Fatal(err)
+	return errors.New("Invalid command")
+}
+
+// fatal logs err and exits
+func fatal(err error) {
+	slog.Error("operation failed", "error", err)
+	os.Exit(1)
+}
+
+// isTimeout tells whether err is caused by the operation or connect
+// deadline, or a deadline of the driver
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, csiclient.ErrConnectTimeout) ||
+		errors.Is(err, csiclient.ErrNotReady) ||
+		status.Code(err) == codes.DeadlineExceeded
+}
+
+func storeKind(cfg *config.Config) string {
+	if cfg.Store.File.Base != "" {
+		return "file"
 	}
+
+	return "etcd"
 }
 
-func prepareTlsConfig(certFile, keyFile, caFile string) (tlsConfig *tls.Config, err error) {
-	if certFile != "" && keyFile != "" {
-		tlsConfig = &tls.Config{}
+// applyFlags overrides configuration with explicitly set flags or
+// environment variables. CSI settings apply to the default driver.
+func applyFlags(cfg *config.Config) {
+	drv := cfg.Drivers[cfg.DefaultDriver]
 
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			return nil, err
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "cache-dir":
+			cfg.Cache.Dir = cacheDir
+		case "cache-ttl":
+			cfg.Cache.TTL = *cacheTTL
+		case "attach-dir":
+			cfg.Attach.Dir = *attachDir
+		case "provider":
+			cfg.Attach.Provider = *provider
+		case "etcd-store-endpoint":
+			cfg.Store.Etcd.Endpoint = *etcdStoreEndpoint
+		case "etcd-tls-cert":
+			cfg.Store.Etcd.TLS.Cert = *etcdTlsCert
+		case "etcd-tls-key":
+			cfg.Store.Etcd.TLS.Key = *etcdTlsKey
+		case "etcd-tls-ca":
+			cfg.Store.Etcd.TLS.CA = *etcdTlsCA
+		case "etcd-tls-mode":
+			cfg.Store.Etcd.TLS.Mode = *etcdTlsMode
+		case "etcd-tls-server-name":
+			cfg.Store.Etcd.TLS.ServerName = *etcdTlsServerName
+		case "etcd-tls-pin-sha256":
+			cfg.Store.Etcd.TLS.PinSHA256 = *etcdTlsPinSHA256
+		case "file-store-base":
+			cfg.Store.File.Base = *fileStoreBase
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "metrics-textfile":
+			cfg.Metrics.Textfile = *metricsTextfile
+		case "tracing-exporter":
+			cfg.Tracing.Exporter = *tracingExporter
+		case "tracing-endpoint":
+			cfg.Tracing.Endpoint = *tracingEndpoint
+		case "tracing-file":
+			cfg.Tracing.File = *tracingFile
 		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
-
-		if caFile != "" {
-			roots := x509.NewCertPool()
-			cacerts, err := os.ReadFile(caFile)
-			if err != nil {
-				return nil, err
-			}
-			roots.AppendCertsFromPEM(cacerts)
-
-			// Perform server validation, only check CA trust model
-			tlsConfig.InsecureSkipVerify = true
-			tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
-				opts := x509.VerifyOptions{
-					Intermediates: x509.NewCertPool(),
-					Roots:         roots,
-					KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
-				}
-				for _, cert := range cs.PeerCertificates[1:] {
-					opts.Intermediates.AddCert(cert)
-				}
-				_, err := cs.PeerCertificates[0].Verify(opts)
-				return err
-			}
+
+		if drv == nil {
+			return
 		}
-	}
 
-	return
+		switch f.Name {
+		case "csi-endpoint":
+			drv.Endpoint = *csiEndpoint
+		case "csi-tls-cert":
+			drv.TLS.Cert = *csiTlsCert
+		case "csi-tls-key":
+			drv.TLS.Key = *csiTlsKey
+		case "csi-tls-ca":
+			drv.TLS.CA = *csiTlsCA
+		case "csi-tls-mode":
+			drv.TLS.Mode = *csiTlsMode
+		case "csi-tls-server-name":
+			drv.TLS.ServerName = *csiTlsServerName
+		case "csi-tls-pin-sha256":
+			drv.TLS.PinSHA256 = *csiTlsPinSHA256
+		case "csi-controller-endpoint":
+			drv.Controller.Endpoint = *csiControllerEndpoint
+		case "csi-node-endpoint":
+			drv.Node.Endpoint = *csiNodeEndpoint
+		case "csi-ready-timeout":
+			drv.Timeouts.Ready = *csiReadyTimeout
+		case "csi-connect-timeout":
+			drv.Timeouts.Connect = *csiConnectTimeout
+		case "csi-device-timeout":
+			drv.Timeouts.Device = *csiDeviceTimeout
+		case "csi-settle":
+			drv.Settle = *csiSettle
+		case "operation-timeout":
+			drv.Timeouts.Operation = *operationTimeout
+		}
+	})
 }
@@ -0,0 +1,203 @@
+// Package blockdev queries block devices
+package blockdev
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// pollInterval is the interval of checking for a device to appear
+	pollInterval = 200 * time.Millisecond
+
+	// probeSize is the number of bytes read by Probe
+	probeSize = 4096
+
+	sysBlock = "/sys/class/block"
+)
+
+// Size returns the size of a block device in bytes
+func Size(dev string) (int64, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	size, err := unix.IoctlGetInt(int(f.Fd()), unix.BLKGETSIZE64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", dev, err)
+	}
+
+	return int64(size), nil
+}
+
+// Wait waits until file resolves to a block device node, and returns the
+// node
+func Wait(ctx context.Context, file string) (string, error) {
+	for {
+		dev, err := resolve(file)
+		if err == nil {
+			return dev, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("waiting for block device %s: %w: %v", file, ctx.Err(), err)
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// resolve resolves file to a block device node
+func resolve(file string) (string, error) {
+	dev, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return "", err
+	}
+
+	st, err := os.Stat(dev)
+	if err != nil {
+		return "", err
+	}
+
+	if st.Mode()&os.ModeDevice == 0 || st.Mode()&os.ModeCharDevice != 0 {
+		return "", fmt.Errorf("%s is not a block device", dev)
+	}
+
+	return dev, nil
+}
+
+// Settle waits for udev to process pending events, when udevadm is
+// available
+func Settle(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "udevadm", "settle").CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("udevadm settle: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// Holder returns the multipath map holding dev, or dev itself. Device-mapper
+// nodes are returned by their /dev/mapper name.
+func Holder(dev string) (string, error) {
+	name, err := sysName(dev)
+	if err != nil {
+		return "", err
+	}
+
+	holders, err := os.ReadDir(path.Join(sysBlock, name, "holders"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	for _, holder := range holders {
+		uuid, err := os.ReadFile(path.Join(sysBlock, holder.Name(), "dm", "uuid"))
+		if err != nil {
+			continue
+		}
+
+		// paths of a multipath map must not be used directly
+		if strings.HasPrefix(string(uuid), "mpath-") {
+			return mapperNode(holder.Name())
+		}
+	}
+
+	if strings.HasPrefix(name, "dm-") {
+		return mapperNode(name)
+	}
+
+	return dev, nil
+}
+
+// sysName returns the sysfs name of the block device node dev, which may
+// be bind-mounted under any name
+func sysName(dev string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(dev, &st); err != nil {
+		return "", fmt.Errorf("%s: %w", dev, err)
+	}
+
+	link, err := os.Readlink(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev)))
+	if err != nil {
+		return "", err
+	}
+
+	return path.Base(link), nil
+}
+
+// mapperNode returns the /dev/mapper node of a device-mapper device
+func mapperNode(name string) (string, error) {
+	dmName, err := os.ReadFile(path.Join(sysBlock, name, "dm", "name"))
+	if err != nil {
+		return "", err
+	}
+
+	node := path.Join("/dev/mapper", strings.TrimSpace(string(dmName)))
+	if _, err = resolve(node); err != nil {
+		return "", err
+	}
+
+	return node, nil
+}
+
+// Probe reads the first block of dev, to confirm it is readable
+func Probe(dev string) error {
+	f, err := os.Open(dev)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, probeSize)
+	if _, err = f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("reading %s: %w", dev, err)
+	}
+
+	return nil
+}
+
+// Users returns the processes holding dev open
+func Users(dev string) ([]int, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(dev, &st); err != nil {
+		return nil, fmt.Errorf("%s: %w", dev, err)
+	}
+
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, fd := range fds {
+		var fst unix.Stat_t
+		// processes and descriptors come and go
+		if unix.Stat(fd, &fst) != nil || fst.Mode&unix.S_IFMT != unix.S_IFBLK || fst.Rdev != st.Rdev {
+			continue
+		}
+
+		pid, err := strconv.Atoi(strings.Split(fd, "/")[2])
+		if err == nil && !slices.Contains(pids, pid) {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
@@ -0,0 +1,571 @@
+// Package config provides the structured configuration of
+// ganeti-extstorage-csi
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	truenas "github.com/dravanet/truenas-csi/pkg/config"
+	"gopkg.in/yaml.v3"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+)
+
+// Operations are the extstorage operations, and gc
+var Operations = []string{"create", "attach", "detach", "remove", "grow", "setinfo", "verify", "open", "close", "gc"}
+
+// Access types
+const (
+	AccessTypeBlock = "block"
+	AccessTypeMount = "mount"
+)
+
+// Offline expansion policies
+const (
+	OfflineExpansionRefuse = "refuse"
+	OfflineExpansionCycle  = "cycle"
+)
+
+// Tracing exporters
+const (
+	TracingExporterOTLP = "otlp"
+	TracingExporterFile = "file"
+)
+
+// Log formats
+const (
+	LogFormatText   = "text"
+	LogFormatJSON   = "json"
+	LogFormatSyslog = "syslog"
+)
+
+// Defaults
+const (
+	DefaultDriverName       = "default"
+	DefaultEndpoint         = "unix:///csi/csi.sock"
+	DefaultAccessMode       = "MULTI_NODE_MULTI_WRITER"
+	DefaultOverheadPercent  = 5
+	DefaultEtcdEndpoint     = "localhost:2379"
+	DefaultCacheDir         = "/var/cache/ganeti-extstorage-csi"
+	DefaultAttachDir        = "/srv/ganeti/ganeti-extstorage-csi"
+	DefaultCacheTTL         = time.Hour
+	DefaultReadyTimeout     = 30 * time.Second
+	DefaultConnectTimeout   = 5 * time.Second
+	DefaultOperationTimeout = time.Minute
+	DefaultDeviceTimeout    = 30 * time.Second
+	DefaultCreateTimeout    = 10 * time.Minute
+	DefaultLogLevel         = "info"
+	DefaultTracingEndpoint  = "localhost:4317"
+)
+
+// Config is the top-level configuration
+type Config struct {
+	// DefaultDriver names the driver used for new volumes
+	DefaultDriver string `yaml:"defaultDriver"`
+	// Drivers are the configured CSI drivers, by name
+	Drivers map[string]*Driver `yaml:"drivers"`
+	// Store configures the metadata store
+	Store Store `yaml:"store"`
+	// Cache configures the node-local capability cache
+	Cache Cache `yaml:"cache"`
+	// Attach configures where volumes are attached on the node
+	Attach Attach `yaml:"attach"`
+	// Log configures logging
+	Log Log `yaml:"log"`
+	// Metrics configures Prometheus metrics
+	Metrics Metrics `yaml:"metrics"`
+	// Tracing configures OpenTelemetry tracing
+	Tracing Tracing `yaml:"tracing"`
+	// Retry configures retrying transient errors
+	Retry Retry `yaml:"retry"`
+
+	// implicitDriver is set when the default driver has been set up from
+	// environment variables, without a configured one
+	implicitDriver bool
+}
+
+// Driver describes how to talk to a CSI driver
+type Driver struct {
+	// Endpoint is the gRPC endpoint of the driver
+	Endpoint string `yaml:"endpoint"`
+	// TLS configures transport security towards the driver
+	TLS TLS `yaml:"tls"`
+	// Controller overrides Endpoint and TLS for the controller service
+	Controller Service `yaml:"controller"`
+	// Node overrides Endpoint and TLS for the node service
+	Node Service `yaml:"node"`
+	// AccessMode is the CSI access mode volumes are requested with
+	AccessMode string `yaml:"accessMode"`
+	// AccessType is either block, or mount for filesystem-only drivers.
+	// Mount volumes hold a loop-backed image file.
+	AccessType string `yaml:"accessType"`
+	// Mount configures mount volumes
+	Mount Mount `yaml:"mount"`
+	// Allocation configures rounding of requested sizes
+	Allocation Allocation `yaml:"allocation"`
+	// Settle waits for udev to settle before validating published devices
+	Settle bool `yaml:"settle"`
+	// Parameters are passed to CreateVolume as they are
+	Parameters map[string]string `yaml:"parameters"`
+	// ExtParams maps Ganeti ext-params to CreateVolume parameters
+	ExtParams map[string]string `yaml:"extParams"`
+	// Topology are the segments new volumes are required to be accessible
+	// from. When neither these, nor the csi_topology ext-param is given,
+	// the topology of the creating node is required.
+	Topology map[string]string `yaml:"topology"`
+	// URIs are userspace access URI templates by hypervisor, e.g.
+	// kvm: "rbd:{{.VolumeContext.pool}}/{{.VolumeContext.imageName}}"
+	URIs map[string]string `yaml:"uris"`
+	// UserspaceOnly skips publishing volumes on the node, attach reports
+	// URIs only
+	UserspaceOnly bool `yaml:"userspaceOnly"`
+	// OfflineExpansion is what grow does with volumes attached on the node
+	// when the driver supports offline expansion only: refuse, or cycle
+	// detaching, expanding and re-attaching them
+	OfflineExpansion string `yaml:"offlineExpansion"`
+	// Secrets configures credentials passed to the driver
+	Secrets Secrets `yaml:"secrets"`
+	// Timeouts configures deadlines of requests
+	Timeouts Timeouts `yaml:"timeouts"`
+}
+
+// Mount configures mount volumes holding image files
+type Mount struct {
+	// FsType is the filesystem type requested from the driver
+	FsType string `yaml:"fsType"`
+	// MountFlags are passed to the driver
+	MountFlags []string `yaml:"mountFlags"`
+	// OverheadPercent is the extra capacity requested over the image size,
+	// for filesystem metadata
+	OverheadPercent int64 `yaml:"overheadPercent"`
+}
+
+// Allocation is the size rounding policy of a driver
+type Allocation struct {
+	// GranularityMiB is the allocation unit of the driver, requested sizes
+	// are rounded up to a multiple of it
+	GranularityMiB int64 `yaml:"granularityMiB"`
+	// OvershootPercent is the capacity the driver may allocate over the
+	// requested size of block volumes
+	OvershootPercent int64 `yaml:"overshootPercent"`
+}
+
+// Service is the endpoint of a CSI service
+type Service struct {
+	// Endpoint is the gRPC endpoint of the service
+	Endpoint string `yaml:"endpoint"`
+	// TLS configures transport security towards the service
+	TLS TLS `yaml:"tls"`
+}
+
+// Timeouts configures deadlines
+type Timeouts struct {
+	// Ready limits waiting for a service to appear and report readiness
+	Ready time.Duration `yaml:"ready"`
+	// Connect limits connecting to a service of the driver and discovering
+	// it
+	Connect time.Duration `yaml:"connect"`
+	// Device limits waiting for a published device to appear
+	Device time.Duration `yaml:"device"`
+	// Operation limits a whole extstorage operation
+	Operation time.Duration `yaml:"operation"`
+	// Operations override Operation by extstorage operation, e.g. create
+	Operations map[string]time.Duration `yaml:"operations"`
+}
+
+// Store configures the metadata store
+type Store struct {
+	Etcd EtcdStore `yaml:"etcd"`
+	File FileStore `yaml:"file"`
+}
+
+// EtcdStore configures the etcd store
+type EtcdStore struct {
+	Endpoint string `yaml:"endpoint"`
+	TLS      TLS    `yaml:"tls"`
+}
+
+// FileStore configures the file store. When Base is set, it takes
+// precedence over etcd. This is just for development.
+type FileStore struct {
+	Base string `yaml:"base"`
+}
+
+// Attach configures the directories of attached volumes
+type Attach struct {
+	// Dir is the base directory of attached volumes
+	Dir string `yaml:"dir"`
+	// Provider is the extstorage provider name, volumes are attached in
+	// its subdirectory of Dir
+	Provider string `yaml:"provider"`
+}
+
+// Cache configures the capability cache
+type Cache struct {
+	// Dir is the cache directory, empty disables caching
+	Dir *string `yaml:"dir"`
+	// TTL is the maximum age of cache entries
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// Metrics configures Prometheus metrics
+type Metrics struct {
+	// Textfile is the *.prom file in the textfile collector directory of
+	// node_exporter, empty disables metrics
+	Textfile string `yaml:"textfile"`
+}
+
+// Tracing configures OpenTelemetry tracing
+type Tracing struct {
+	// Exporter is otlp or file, empty disables tracing
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the OTLP gRPC endpoint of the collector
+	Endpoint string `yaml:"endpoint"`
+	// File is the file spans are appended to as JSON
+	File string `yaml:"file"`
+}
+
+// Log configures logging
+type Log struct {
+	// Format is one of text, json or syslog
+	Format string `yaml:"format"`
+	// Level is one of debug, info, warn or error
+	Level string `yaml:"level"`
+}
+
+// Default returns the configuration used when no configuration file is given
+func Default() *Config {
+	cfg := &Config{}
+	cfg.setDefaults()
+
+	return cfg
+}
+
+// Load reads configuration from a YAML file. Unknown keys are rejected, an
+// empty file configures nothing.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	cfg := &Config{}
+	if err = dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	cfg.setDefaults()
+
+	return cfg, nil
+}
+
+func (c *Config) setDefaults() {
+	if len(c.Drivers) == 0 {
+		c.implicitDriver = true
+		c.Drivers = map[string]*Driver{
+			DefaultDriverName: {
+				ExtParams: map[string]string{
+					"truenas_csi_nas":    truenas.NasSelector,
+					"truenas_csi_config": truenas.ConfigSelector,
+				},
+			},
+		}
+	}
+
+	if c.DefaultDriver == "" && len(c.Drivers) == 1 {
+		for name := range c.Drivers {
+			c.DefaultDriver = name
+		}
+	}
+
+	for _, drv := range c.Drivers {
+		if drv == nil {
+			continue
+		}
+		if drv.Endpoint == "" {
+			drv.Endpoint = DefaultEndpoint
+		}
+		if drv.AccessMode == "" {
+			drv.AccessMode = DefaultAccessMode
+		}
+		if drv.AccessType == "" {
+			drv.AccessType = AccessTypeBlock
+		}
+		if drv.OfflineExpansion == "" {
+			drv.OfflineExpansion = OfflineExpansionRefuse
+		}
+		if drv.Mount.OverheadPercent == 0 {
+			drv.Mount.OverheadPercent = DefaultOverheadPercent
+		}
+		if drv.Timeouts.Ready == 0 {
+			drv.Timeouts.Ready = DefaultReadyTimeout
+		}
+		if drv.Timeouts.Connect == 0 {
+			drv.Timeouts.Connect = DefaultConnectTimeout
+		}
+		if drv.Timeouts.Device == 0 {
+			drv.Timeouts.Device = DefaultDeviceTimeout
+		}
+		if drv.Timeouts.Operation == 0 {
+			drv.Timeouts.Operation = DefaultOperationTimeout
+		}
+	}
+
+	if c.Store.Etcd.Endpoint == "" {
+		c.Store.Etcd.Endpoint = DefaultEtcdEndpoint
+	}
+
+	if c.Cache.Dir == nil {
+		dir := DefaultCacheDir
+		c.Cache.Dir = &dir
+	}
+	if c.Cache.TTL == 0 {
+		c.Cache.TTL = DefaultCacheTTL
+	}
+
+	if c.Attach.Dir == "" {
+		c.Attach.Dir = DefaultAttachDir
+	}
+
+	c.Retry.setDefaults()
+
+	if c.Tracing.Endpoint == "" {
+		c.Tracing.Endpoint = DefaultTracingEndpoint
+	}
+
+	if c.Log.Format == "" {
+		c.Log.Format = LogFormatText
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = DefaultLogLevel
+	}
+}
+
+// Validate checks the configuration, reporting all problems found
+func (c *Config) Validate() error {
+	var errs []error
+
+	if len(c.Drivers) == 0 {
+		errs = append(errs, errors.New("no drivers defined"))
+	}
+
+	if c.DefaultDriver == "" {
+		errs = append(errs, errors.New("defaultDriver must be set when multiple drivers are defined"))
+	} else if _, ok := c.Drivers[c.DefaultDriver]; !ok {
+		errs = append(errs, fmt.Errorf("defaultDriver %q is not defined in drivers", c.DefaultDriver))
+	}
+
+	for _, name := range sortedKeys(c.Drivers) {
+		drv := c.Drivers[name]
+		if drv == nil {
+			errs = append(errs, fmt.Errorf("driver %q: empty definition", name))
+			continue
+		}
+		for _, err := range drv.validate() {
+			errs = append(errs, fmt.Errorf("driver %q: %w", name, err))
+		}
+	}
+
+	if c.Store.File.Base == "" {
+		if err := c.Store.Etcd.TLS.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("store.etcd.tls: %w", err))
+		}
+	}
+
+	if c.Cache.TTL < 0 {
+		errs = append(errs, errors.New("cache.ttl must not be negative"))
+	}
+
+	if !path.IsAbs(c.Attach.Dir) {
+		errs = append(errs, fmt.Errorf("attach.dir %q must be absolute", c.Attach.Dir))
+	}
+	if p := c.Attach.Provider; p == "." || p == ".." || strings.Contains(p, "/") {
+		errs = append(errs, fmt.Errorf("invalid attach.provider %q", p))
+	}
+
+	switch c.Log.Format {
+	case LogFormatText, LogFormatJSON, LogFormatSyslog:
+	default:
+		errs = append(errs, fmt.Errorf("invalid log.format %q, expected %s, %s or %s", c.Log.Format, LogFormatText, LogFormatJSON, LogFormatSyslog))
+	}
+
+	if c.Metrics.Textfile != "" && !strings.HasSuffix(c.Metrics.Textfile, ".prom") {
+		errs = append(errs, fmt.Errorf("metrics.textfile %q must have .prom suffix", c.Metrics.Textfile))
+	}
+
+	switch c.Tracing.Exporter {
+	case "", TracingExporterOTLP:
+	case TracingExporterFile:
+		if c.Tracing.File == "" {
+			errs = append(errs, errors.New("tracing.file is required by the file exporter"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid tracing.exporter %q, expected %s or %s", c.Tracing.Exporter, TracingExporterOTLP, TracingExporterFile))
+	}
+
+	errs = append(errs, c.Retry.validate()...)
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log.level %q", c.Log.Level))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (d *Driver) validate() (errs []error) {
+	if _, ok := csi.VolumeCapability_AccessMode_Mode_value[d.AccessMode]; !ok || d.AccessMode == "UNKNOWN" {
+		errs = append(errs, fmt.Errorf("invalid accessMode %q", d.AccessMode))
+	}
+
+	if d.AccessType != AccessTypeBlock && d.AccessType != AccessTypeMount {
+		errs = append(errs, fmt.Errorf("invalid accessType %q, expected %s or %s", d.AccessType, AccessTypeBlock, AccessTypeMount))
+	}
+
+	if d.OfflineExpansion != OfflineExpansionRefuse && d.OfflineExpansion != OfflineExpansionCycle {
+		errs = append(errs, fmt.Errorf("invalid offlineExpansion %q, expected %s or %s", d.OfflineExpansion, OfflineExpansionRefuse, OfflineExpansionCycle))
+	}
+
+	if d.Mount.OverheadPercent < 0 {
+		errs = append(errs, errors.New("mount.overheadPercent must not be negative"))
+	}
+
+	if d.Allocation.GranularityMiB < 0 {
+		errs = append(errs, errors.New("allocation.granularityMiB must not be negative"))
+	}
+	if d.Allocation.OvershootPercent < 0 {
+		errs = append(errs, errors.New("allocation.overshootPercent must not be negative"))
+	}
+
+	if err := d.TLS.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+	if err := d.Controller.TLS.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("controller.tls: %w", err))
+	}
+	if err := d.Node.TLS.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("node.tls: %w", err))
+	}
+
+	if d.Timeouts.Ready < 0 || d.Timeouts.Connect < 0 || d.Timeouts.Device < 0 || d.Timeouts.Operation < 0 {
+		errs = append(errs, errors.New("timeouts must not be negative"))
+	}
+	for _, op := range sortedKeys(d.Timeouts.Operations) {
+		if !slices.Contains(Operations, op) {
+			errs = append(errs, fmt.Errorf("timeouts.operations: unknown operation %q", op))
+		} else if d.Timeouts.Operations[op] <= 0 {
+			errs = append(errs, fmt.Errorf("timeouts.operations.%s must be positive", op))
+		}
+	}
+
+	for hypervisor, uri := range d.URIs {
+		if _, err := ParseURITemplate(hypervisor, uri); err != nil {
+			errs = append(errs, fmt.Errorf("uris: %w", err))
+		}
+	}
+
+	if d.UserspaceOnly && len(d.URIs) == 0 {
+		errs = append(errs, errors.New("userspaceOnly requires uris"))
+	}
+
+	errs = append(errs, d.Secrets.validate()...)
+
+	for param, key := range d.ExtParams {
+		if key == "" {
+			errs = append(errs, fmt.Errorf("extParams: ext-param %q is mapped to an empty parameter", param))
+		}
+	}
+
+	return
+}
+
+// OperationTimeout returns the deadline of an extstorage operation. As the
+// driver serving a volume is only known from the store, this is the largest
+// one among drivers.
+func (c *Config) OperationTimeout(op string) (timeout time.Duration) {
+	for _, drv := range c.Drivers {
+		if t := drv.OperationTimeout(op); t > timeout {
+			timeout = t
+		}
+	}
+
+	return
+}
+
+// OperationTimeout returns the deadline of an extstorage operation
+func (d *Driver) OperationTimeout(op string) time.Duration {
+	if t, ok := d.Timeouts.Operations[op]; ok {
+		return t
+	}
+
+	// creates and clones of large volumes take long, unless operations
+	// are given even longer
+	if op == "create" {
+		return max(d.Timeouts.Operation, DefaultCreateTimeout)
+	}
+
+	return d.Timeouts.Operation
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// ControllerService returns the endpoint of the controller service
+func (d *Driver) ControllerService() Service {
+	if d.Controller.Endpoint != "" {
+		return d.Controller
+	}
+
+	return Service{Endpoint: d.Endpoint, TLS: d.TLS}
+}
+
+// NodeService returns the endpoint of the node service
+func (d *Driver) NodeService() Service {
+	if d.Node.Endpoint != "" {
+		return d.Node
+	}
+
+	return Service{Endpoint: d.Endpoint, TLS: d.TLS}
+}
+
+// Mode returns the configured CSI access mode
+func (d *Driver) Mode() csi.VolumeCapability_AccessMode_Mode {
+	return csi.VolumeCapability_AccessMode_Mode(csi.VolumeCapability_AccessMode_Mode_value[d.AccessMode])
+}
+
+// Shareable tells whether volumes of the CSI access mode may be written by
+// several nodes at once, as live migration requires
+func Shareable(mode string) bool {
+	return mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER.String()
+}
+
+// RecordedDriver returns the driver name to record for volumes of the named
+// driver. The implicit default driver is recorded as "", the default driver,
+// so volumes keep working once a configuration file names its driver.
+func (c *Config) RecordedDriver(name string) string {
+	if c.implicitDriver && name == DefaultDriverName {
+		return ""
+	}
+
+	return name
+}
@@ -0,0 +1,335 @@
+package config
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareable(t *testing.T) {
+	tests := []struct {
+		mode string
+		want bool
+	}{
+		{"MULTI_NODE_MULTI_WRITER", true},
+		{"MULTI_NODE_SINGLE_WRITER", false},
+		{"MULTI_NODE_READER_ONLY", false},
+		{"SINGLE_NODE_WRITER", false},
+		{"SINGLE_NODE_MULTI_WRITER", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := Shareable(tt.mode); got != tt.want {
+			t.Errorf("Shareable(%q) = %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestRecordedDriver(t *testing.T) {
+	implicit := Default()
+	configured := &Config{Drivers: map[string]*Driver{DefaultDriverName: {}}}
+	configured.setDefaults()
+
+	tests := []struct {
+		name string
+		cfg  *Config
+		drv  string
+		want string
+	}{
+		{"implicit default", implicit, DefaultDriverName, ""},
+		{"configured default", configured, DefaultDriverName, DefaultDriverName},
+		{"other", configured, "fast", "fast"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.cfg.RecordedDriver(tt.drv); got != tt.want {
+			t.Errorf("%s: RecordedDriver(%q) = %q, want %q", tt.name, tt.drv, got, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+		check   func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "drivers",
+			data: `
+defaultDriver: fast
+drivers:
+  fast:
+    endpoint: unix:///csi/fast.sock
+  slow:
+    accessType: mount
+`,
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DefaultDriver != "fast" || len(cfg.Drivers) != 2 {
+					t.Errorf("drivers = %v, default %q", sortedKeys(cfg.Drivers), cfg.DefaultDriver)
+				}
+				if cfg.Drivers["fast"].Endpoint != "unix:///csi/fast.sock" {
+					t.Errorf("endpoint = %q", cfg.Drivers["fast"].Endpoint)
+				}
+				if cfg.RecordedDriver("fast") != "fast" {
+					t.Errorf("configured driver recorded as implicit")
+				}
+			},
+		},
+		{
+			name: "single driver is the default",
+			data: "drivers:\n  only: {}\n",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DefaultDriver != "only" {
+					t.Errorf("defaultDriver = %q, want only", cfg.DefaultDriver)
+				}
+			},
+		},
+		{
+			name: "empty",
+			data: "",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DefaultDriver != DefaultDriverName {
+					t.Errorf("defaultDriver = %q, want %s", cfg.DefaultDriver, DefaultDriverName)
+				}
+			},
+		},
+		{
+			name: "comments only",
+			data: "# nothing configured yet\n",
+			check: func(t *testing.T, cfg *Config) {
+				if _, ok := cfg.Drivers[DefaultDriverName]; !ok {
+					t.Errorf("drivers = %v, want the implicit default", sortedKeys(cfg.Drivers))
+				}
+			},
+		},
+		{
+			name:    "unknown key",
+			data:    "drivers:\n  fast:\n    endpont: x\n",
+			wantErr: true,
+		},
+		{
+			name:    "malformed",
+			data:    "drivers: [",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(file, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := Load(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+
+	if _, err := Load(path.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Load() of a missing file succeeded")
+	}
+}
+
+func TestDriverDefaults(t *testing.T) {
+	cfg := &Config{Drivers: map[string]*Driver{
+		"plain": {},
+		"set": {
+			Endpoint:   "unix:///csi/set.sock",
+			AccessMode: "SINGLE_NODE_WRITER",
+			AccessType: AccessTypeMount,
+			Mount:      Mount{OverheadPercent: 10},
+			Timeouts:   Timeouts{Operation: 2 * time.Minute},
+		},
+	}}
+	cfg.setDefaults()
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"plain endpoint", cfg.Drivers["plain"].Endpoint, DefaultEndpoint},
+		{"plain accessMode", cfg.Drivers["plain"].AccessMode, DefaultAccessMode},
+		{"plain accessType", cfg.Drivers["plain"].AccessType, AccessTypeBlock},
+		{"plain offlineExpansion", cfg.Drivers["plain"].OfflineExpansion, OfflineExpansionRefuse},
+		{"plain overheadPercent", cfg.Drivers["plain"].Mount.OverheadPercent, int64(DefaultOverheadPercent)},
+		{"plain connect timeout", cfg.Drivers["plain"].Timeouts.Connect, DefaultConnectTimeout},
+		{"plain operation timeout", cfg.Drivers["plain"].Timeouts.Operation, DefaultOperationTimeout},
+		{"set endpoint", cfg.Drivers["set"].Endpoint, "unix:///csi/set.sock"},
+		{"set accessMode", cfg.Drivers["set"].AccessMode, "SINGLE_NODE_WRITER"},
+		{"set accessType", cfg.Drivers["set"].AccessType, AccessTypeMount},
+		{"set overheadPercent", cfg.Drivers["set"].Mount.OverheadPercent, int64(10)},
+		{"set operation timeout", cfg.Drivers["set"].Timeouts.Operation, 2 * time.Minute},
+		{"no default driver", cfg.DefaultDriver, ""},
+		{"attach dir", cfg.Attach.Dir, DefaultAttachDir},
+		{"etcd endpoint", cfg.Store.Etcd.Endpoint, DefaultEtcdEndpoint},
+		{"cache dir", *cfg.Cache.Dir, DefaultCacheDir},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{name: "default"},
+		{
+			name:    "unknown default driver",
+			modify:  func(c *Config) { c.DefaultDriver = "missing" },
+			wantErr: `defaultDriver "missing" is not defined`,
+		},
+		{
+			name: "no default among several",
+			modify: func(c *Config) {
+				c.Drivers["other"] = c.Drivers[DefaultDriverName]
+				c.DefaultDriver = ""
+			},
+			wantErr: "defaultDriver must be set",
+		},
+		{
+			name:    "empty driver",
+			modify:  func(c *Config) { c.Drivers["other"] = nil },
+			wantErr: `driver "other": empty definition`,
+		},
+		{
+			name:    "access mode",
+			modify:  func(c *Config) { c.Drivers[DefaultDriverName].AccessMode = "UNKNOWN" },
+			wantErr: `invalid accessMode "UNKNOWN"`,
+		},
+		{
+			name:    "access type",
+			modify:  func(c *Config) { c.Drivers[DefaultDriverName].AccessType = "file" },
+			wantErr: `invalid accessType "file"`,
+		},
+		{
+			name:    "offline expansion",
+			modify:  func(c *Config) { c.Drivers[DefaultDriverName].OfflineExpansion = "retry" },
+			wantErr: `invalid offlineExpansion "retry"`,
+		},
+		{
+			name:    "negative granularity",
+			modify:  func(c *Config) { c.Drivers[DefaultDriverName].Allocation.GranularityMiB = -1 },
+			wantErr: "granularityMiB must not be negative",
+		},
+		{
+			name:    "driver tls",
+			modify:  func(c *Config) { c.Drivers[DefaultDriverName].Controller.TLS.Cert = "c.pem" },
+			wantErr: "controller.tls: cert and key must be given together",
+		},
+		{
+			name: "unknown operation timeout",
+			modify: func(c *Config) {
+				c.Drivers[DefaultDriverName].Timeouts.Operations = map[string]time.Duration{"resize": time.Minute}
+			},
+			wantErr: `unknown operation "resize"`,
+		},
+		{
+			name: "zero operation timeout",
+			modify: func(c *Config) {
+				c.Drivers[DefaultDriverName].Timeouts.Operations = map[string]time.Duration{"create": 0}
+			},
+			wantErr: "timeouts.operations.create must be positive",
+		},
+		{
+			name:    "etcd tls",
+			modify:  func(c *Config) { c.Store.Etcd.TLS.Mode = "insecure" },
+			wantErr: "store.etcd.tls",
+		},
+		{
+			name: "etcd tls unused by the file store",
+			modify: func(c *Config) {
+				c.Store.Etcd.TLS.Mode = "insecure"
+				c.Store.File.Base = "/var/lib/ganeti-extstorage-csi"
+			},
+		},
+		{
+			name:    "relative attach dir",
+			modify:  func(c *Config) { c.Attach.Dir = "srv" },
+			wantErr: "must be absolute",
+		},
+		{
+			name:    "provider path",
+			modify:  func(c *Config) { c.Attach.Provider = "../csi" },
+			wantErr: "invalid attach.provider",
+		},
+		{
+			name:    "log format",
+			modify:  func(c *Config) { c.Log.Format = "xml" },
+			wantErr: `invalid log.format "xml"`,
+		},
+		{
+			name:    "log level",
+			modify:  func(c *Config) { c.Log.Level = "verbose" },
+			wantErr: `invalid log.level "verbose"`,
+		},
+		{
+			name:    "metrics textfile",
+			modify:  func(c *Config) { c.Metrics.Textfile = "/var/lib/metrics.txt" },
+			wantErr: "must have .prom suffix",
+		},
+		{
+			name:    "tracing file",
+			modify:  func(c *Config) { c.Tracing.Exporter = TracingExporterFile },
+			wantErr: "tracing.file is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Attach.Provider = "csi"
+			if tt.modify != nil {
+				tt.modify(cfg)
+			}
+
+			err := cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation time.Duration
+		overrides map[string]time.Duration
+		op        string
+		want      time.Duration
+	}{
+		{"operation", time.Minute, nil, "attach", time.Minute},
+		{"create default", time.Minute, nil, "create", DefaultCreateTimeout},
+		{"create not shorter than operation", time.Hour, nil, "create", time.Hour},
+		{"override", time.Minute, map[string]time.Duration{"attach": 5 * time.Minute}, "attach", 5 * time.Minute},
+		{"create override", time.Hour, map[string]time.Duration{"create": time.Minute}, "create", time.Minute},
+	}
+
+	for _, tt := range tests {
+		d := &Driver{Timeouts: Timeouts{Operation: tt.operation, Operations: tt.overrides}}
+		if got := d.OperationTimeout(tt.op); got != tt.want {
+			t.Errorf("%s: OperationTimeout(%s) = %s, want %s", tt.name, tt.op, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Store calls, as named in retry policies
+const (
+	RetryStoreAdd    = "store.add"
+	RetryStoreGet    = "store.get"
+	RetryStoreUpdate = "store.update"
+	RetryStoreRemove = "store.remove"
+)
+
+// Retry defaults
+const (
+	DefaultRetryMaxAttempts    = 5
+	DefaultRetryInitialBackoff = 200 * time.Millisecond
+	DefaultRetryMaxBackoff     = 5 * time.Second
+	DefaultRetryBudget         = 30 * time.Second
+)
+
+// DefaultRetryCodes are the gRPC codes the CSI spec expects callers to retry
+var DefaultRetryCodes = []string{
+	codes.Unavailable.String(),
+	codes.Aborted.String(),
+	codes.DeadlineExceeded.String(),
+	codes.ResourceExhausted.String(),
+}
+
+// Retry configures retrying transient errors of CSI and store calls
+type Retry struct {
+	// Default applies to calls without a policy of their own
+	Default RetryPolicy `yaml:"default"`
+	// Methods override the default by CSI method name, e.g. CreateVolume,
+	// or store call: store.add, store.get, store.update or store.remove
+	Methods map[string]RetryPolicy `yaml:"methods"`
+}
+
+// RetryPolicy configures retries of a call. Unset fields of method
+// policies are taken from the default.
+type RetryPolicy struct {
+	// MaxAttempts limits attempts, 1 disables retries
+	MaxAttempts int `yaml:"maxAttempts"`
+	// InitialBackoff is the delay before the first retry, doubled for
+	// each further one
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	// MaxBackoff caps delays
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+	// Budget limits the time spent on all attempts, within the operation
+	// deadline
+	Budget time.Duration `yaml:"budget"`
+	// Codes are the retried gRPC status codes, e.g. Unavailable
+	Codes []string `yaml:"codes"`
+}
+
+func (r *Retry) setDefaults() {
+	if r.Default.MaxAttempts == 0 {
+		r.Default.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if r.Default.InitialBackoff == 0 {
+		r.Default.InitialBackoff = DefaultRetryInitialBackoff
+	}
+	if r.Default.MaxBackoff == 0 {
+		r.Default.MaxBackoff = DefaultRetryMaxBackoff
+	}
+	if r.Default.Budget == 0 {
+		r.Default.Budget = DefaultRetryBudget
+	}
+	if r.Default.Codes == nil {
+		r.Default.Codes = DefaultRetryCodes
+	}
+
+	if r.Methods == nil {
+		r.Methods = make(map[string]RetryPolicy)
+	}
+	// A timed out add may have succeeded, replaying it would fail as the
+	// volume exists. Only retry when etcd was not reached.
+	if _, ok := r.Methods[RetryStoreAdd]; !ok {
+		r.Methods[RetryStoreAdd] = RetryPolicy{Codes: []string{codes.Unavailable.String()}}
+	}
+	// Probe is polled while waiting for readiness
+	if _, ok := r.Methods["Probe"]; !ok {
+		r.Methods["Probe"] = RetryPolicy{MaxAttempts: 1}
+	}
+}
+
+func (r *Retry) validate() (errs []error) {
+	if err := r.Default.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("retry.default: %w", err))
+	}
+
+	for _, method := range sortedKeys(r.Methods) {
+		if err := r.Methods[method].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("retry.methods.%s: %w", method, err))
+		}
+	}
+
+	return
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 0 || p.InitialBackoff < 0 || p.MaxBackoff < 0 || p.Budget < 0 {
+		return fmt.Errorf("values must not be negative")
+	}
+
+	for _, name := range p.Codes {
+		if _, ok := parseCode(name); !ok {
+			return fmt.Errorf("unknown gRPC code %q", name)
+		}
+	}
+
+	return nil
+}
+
+// Policy returns the policy of a CSI method or store call
+func (r *Retry) Policy(method string) RetryPolicy {
+	p := r.Default
+
+	o, ok := r.Methods[method]
+	if !ok {
+		return p
+	}
+
+	if o.MaxAttempts != 0 {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.InitialBackoff != 0 {
+		p.InitialBackoff = o.InitialBackoff
+	}
+	if o.MaxBackoff != 0 {
+		p.MaxBackoff = o.MaxBackoff
+	}
+	if o.Budget != 0 {
+		p.Budget = o.Budget
+	}
+	if o.Codes != nil {
+		p.Codes = o.Codes
+	}
+
+	return p
+}
+
+// Retryable tells whether the policy retries code
+func (p RetryPolicy) Retryable(code codes.Code) bool {
+	for _, name := range p.Codes {
+		if c, ok := parseCode(name); ok && c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseCode(name string) (codes.Code, bool) {
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if c.String() == name {
+			return c, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret operations, the CSI requests carrying secrets
+const (
+	SecretsCreateVolume      = "createVolume"
+	SecretsDeleteVolume      = "deleteVolume"
+	SecretsControllerPublish = "controllerPublish"
+	SecretsNodeStage         = "nodeStage"
+	SecretsNodePublish       = "nodePublish"
+	SecretsControllerExpand  = "controllerExpand"
+)
+
+// Secrets configures CSI secrets. The inline source applies to operations
+// without one of their own.
+type Secrets struct {
+	SecretSource `yaml:",inline"`
+
+	// CreateVolume secrets are also used for ValidateVolumeCapabilities
+	CreateVolume *SecretSource `yaml:"createVolume"`
+	DeleteVolume *SecretSource `yaml:"deleteVolume"`
+	// ControllerPublish secrets are also used for ControllerUnpublishVolume
+	ControllerPublish *SecretSource `yaml:"controllerPublish"`
+	NodeStage         *SecretSource `yaml:"nodeStage"`
+	NodePublish       *SecretSource `yaml:"nodePublish"`
+	ControllerExpand  *SecretSource `yaml:"controllerExpand"`
+}
+
+// SecretSource locates secrets. Both files and directories must be owned
+// by the running user and must not be accessible by others.
+type SecretSource struct {
+	// File is a YAML file holding a map of secrets
+	File string `yaml:"file"`
+	// Dir holds a file per secret, named after its key, like a mounted
+	// Kubernetes secret. A single trailing newline is trimmed from values.
+	Dir string `yaml:"dir"`
+}
+
+// Source returns the source of secrets of an operation
+func (s *Secrets) Source(op string) SecretSource {
+	var src *SecretSource
+
+	switch op {
+	case SecretsCreateVolume:
+		src = s.CreateVolume
+	case SecretsDeleteVolume:
+		src = s.DeleteVolume
+	case SecretsControllerPublish:
+		src = s.ControllerPublish
+	case SecretsNodeStage:
+		src = s.NodeStage
+	case SecretsNodePublish:
+		src = s.NodePublish
+	case SecretsControllerExpand:
+		src = s.ControllerExpand
+	}
+
+	if src != nil {
+		return *src
+	}
+
+	return s.SecretSource
+}
+
+func (s *Secrets) validate() (errs []error) {
+	sources := []struct {
+		name string
+		src  *SecretSource
+	}{
+		{"secrets", &s.SecretSource},
+		{"secrets." + SecretsCreateVolume, s.CreateVolume},
+		{"secrets." + SecretsDeleteVolume, s.DeleteVolume},
+		{"secrets." + SecretsControllerPublish, s.ControllerPublish},
+		{"secrets." + SecretsNodeStage, s.NodeStage},
+		{"secrets." + SecretsNodePublish, s.NodePublish},
+		{"secrets." + SecretsControllerExpand, s.ControllerExpand},
+	}
+
+	for _, source := range sources {
+		if source.src != nil && source.src.File != "" && source.src.Dir != "" {
+			errs = append(errs, fmt.Errorf("%s: file and dir are mutually exclusive", source.name))
+		}
+	}
+
+	return
+}
+
+// Load reads the secrets. A missing configuration yields no secrets. Errors
+// never include secret values.
+func (s SecretSource) Load() (map[string]string, error) {
+	switch {
+	case s.File != "":
+		return loadSecretsFile(s.File)
+	case s.Dir != "":
+		return loadSecretsDir(s.Dir)
+	}
+
+	return nil, nil
+}
+
+func loadSecretsFile(file string) (map[string]string, error) {
+	if err := checkPrivate(file); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets map[string]string
+	if err = yaml.Unmarshal(data, &secrets); err != nil {
+		// yaml errors may quote the offending value
+		return nil, fmt.Errorf("parsing secrets file %s: expected a map of strings", file)
+	}
+
+	return secrets, nil
+}
+
+func loadSecretsDir(dir string) (map[string]string, error) {
+	if err := checkPrivate(dir); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string)
+	for _, entry := range entries {
+		// skip hidden entries, like ..data of Kubernetes secret volumes
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		file := path.Join(dir, entry.Name())
+
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		if err = checkPrivate(file); err != nil {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		secrets[entry.Name()] = strings.TrimSuffix(string(data), "\n")
+	}
+
+	return secrets, nil
+}
+
+// checkPrivate refuses secrets readable by others than the running user
+func checkPrivate(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("secrets %s must not be accessible by group or others, mode is %s", name, fi.Mode().Perm())
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("secrets %s must be owned by uid %d", name, os.Geteuid())
+	}
+
+	return nil
+}
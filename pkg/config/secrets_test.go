@@ -0,0 +1,169 @@
+package config
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSecretsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		mode    os.FileMode
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "map",
+			data: "username: admin\npassword: \"s3cr3t\"\n",
+			mode: 0o600,
+			want: map[string]string{"username": "admin", "password": "s3cr3t"},
+		},
+		{
+			name:    "readable by group",
+			data:    "password: s3cr3t\n",
+			mode:    0o640,
+			wantErr: "must not be accessible by group or others",
+		},
+		{
+			name:    "not a map",
+			data:    "- s3cr3t\n",
+			mode:    0o600,
+			wantErr: "expected a map of strings",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), "secrets.yaml")
+			if err := os.WriteFile(file, []byte(tt.data), tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(file, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := SecretSource{File: file}.Load()
+			checkSecrets(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestSecretsDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		dirMode os.FileMode
+		files   map[string]string
+		// modes of files differing from 0600
+		modes   map[string]os.FileMode
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "files",
+			dirMode: 0o700,
+			files:   map[string]string{"username": "admin\n", "password": "s3cr3t\n\n", "..data": "hidden"},
+			want:    map[string]string{"username": "admin", "password": "s3cr3t\n"},
+		},
+		{
+			name:    "dir readable by others",
+			dirMode: 0o755,
+			files:   map[string]string{"password": "s3cr3t"},
+			wantErr: "must not be accessible by group or others",
+		},
+		{
+			name:    "file readable by group",
+			dirMode: 0o700,
+			files:   map[string]string{"password": "s3cr3t"},
+			modes:   map[string]os.FileMode{"password": 0o640},
+			wantErr: "must not be accessible by group or others",
+		},
+		{
+			name:    "empty",
+			dirMode: 0o700,
+			want:    map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := path.Join(t.TempDir(), "secrets")
+			if err := os.Mkdir(dir, 0o700); err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.files {
+				mode, ok := tt.modes[name]
+				if !ok {
+					mode = 0o600
+				}
+				file := path.Join(dir, name)
+				if err := os.WriteFile(file, []byte(value), mode); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(file, mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Chmod(dir, tt.dirMode); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := SecretSource{Dir: dir}.Load()
+			checkSecrets(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestSecretsSource(t *testing.T) {
+	s := Secrets{
+		SecretSource: SecretSource{File: "default.yaml"},
+		NodeStage:    &SecretSource{Dir: "/stage"},
+	}
+
+	tests := []struct {
+		op   string
+		want SecretSource
+	}{
+		{SecretsNodeStage, SecretSource{Dir: "/stage"}},
+		{SecretsCreateVolume, SecretSource{File: "default.yaml"}},
+		{SecretsControllerExpand, SecretSource{File: "default.yaml"}},
+	}
+
+	for _, tt := range tests {
+		if got := s.Source(tt.op); got != tt.want {
+			t.Errorf("Source(%s) = %+v, want %+v", tt.op, got, tt.want)
+		}
+	}
+
+	if got, err := (SecretSource{}).Load(); got != nil || err != nil {
+		t.Errorf("Load() of no source = %v, %v", got, err)
+	}
+
+	both := Secrets{DeleteVolume: &SecretSource{File: "f", Dir: "d"}}
+	if errs := both.validate(); len(errs) != 1 {
+		t.Errorf("validate() = %v, want an error for file and dir", errs)
+	}
+}
+
+func checkSecrets(t *testing.T, got map[string]string, err error, want map[string]string, wantErr string) {
+	t.Helper()
+
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("Load() error = %v, want %q", err, wantErr)
+		}
+		if strings.Contains(err.Error(), "s3cr3t") {
+			t.Errorf("Load() error %q reveals the secret", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %v, want %v", got, want)
+	}
+}
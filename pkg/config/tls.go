@@ -0,0 +1,183 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLS modes
+const (
+	// TLSModeDisabled connects without TLS
+	TLSModeDisabled = "disabled"
+	// TLSModeCA verifies the server certificate chain against the CA, but
+	// not its name
+	TLSModeCA = "ca"
+	// TLSModeVerify verifies the server certificate chain against the CA,
+	// or the system roots, and its name
+	TLSModeVerify = "verify"
+)
+
+// TLS configures a TLS client. A client certificate enables mutual TLS in
+// either mode.
+type TLS struct {
+	// Mode is disabled, ca or verify. When empty, ca is used with a CA but
+	// no server name, as earlier versions did, verify with other TLS
+	// settings, otherwise TLS is disabled.
+	Mode string `yaml:"mode"`
+	// Cert is the client certificate file
+	Cert string `yaml:"cert"`
+	// Key is the client private key file
+	Key string `yaml:"key"`
+	// CA is the certificate authority file the server is verified against
+	CA string `yaml:"ca"`
+	// ServerName overrides the name the server certificate is verified
+	// against, taken from the endpoint by default
+	ServerName string `yaml:"serverName"`
+	// PinSHA256 is the SHA-256 fingerprint of the server certificate, in
+	// hex, optionally colon separated. When set, other certificates are
+	// refused.
+	PinSHA256 string `yaml:"pinSHA256"`
+}
+
+func (t *TLS) mode() string {
+	switch {
+	case t.Mode != "":
+		return t.Mode
+	case t.CA != "" && t.ServerName == "":
+		// endpoints given by address have no name to verify
+		return TLSModeCA
+	case t.CA != "" || t.Cert != "" || t.ServerName != "" || t.PinSHA256 != "":
+		return TLSModeVerify
+	}
+
+	return TLSModeDisabled
+}
+
+func (t *TLS) pin() string {
+	return strings.ToLower(strings.ReplaceAll(t.PinSHA256, ":", ""))
+}
+
+func (t *TLS) validate() error {
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("cert and key must be given together")
+	}
+
+	switch t.mode() {
+	case TLSModeDisabled:
+		if t.Cert != "" || t.CA != "" || t.PinSHA256 != "" {
+			return errors.New("cert, ca and pinSHA256 require TLS to be enabled")
+		}
+	case TLSModeCA:
+		if t.CA == "" {
+			return fmt.Errorf("mode %s requires ca", TLSModeCA)
+		}
+	case TLSModeVerify:
+	default:
+		return fmt.Errorf("invalid mode %q, expected %s, %s or %s", t.Mode, TLSModeDisabled, TLSModeCA, TLSModeVerify)
+	}
+
+	if t.PinSHA256 != "" {
+		if pin, err := hex.DecodeString(t.pin()); err != nil || len(pin) != sha256.Size {
+			return errors.New("pinSHA256 must be a hex SHA-256 fingerprint")
+		}
+	}
+
+	return nil
+}
+
+// Config returns a tls.Config, or nil when TLS is disabled
+func (t *TLS) Config() (*tls.Config, error) {
+	mode := t.mode()
+	if mode == TLSModeDisabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.CA != "" {
+		roots, err := loadCA(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	var verifiers []func(tls.ConnectionState) error
+
+	if mode == TLSModeCA {
+		// Perform server validation, only check CA trust model
+		tlsConfig.InsecureSkipVerify = true
+		roots := tlsConfig.RootCAs
+		verifiers = append(verifiers, func(cs tls.ConnectionState) error {
+			opts := x509.VerifyOptions{
+				Intermediates: x509.NewCertPool(),
+				Roots:         roots,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		})
+	}
+
+	if t.PinSHA256 != "" {
+		pin := t.pin()
+		verifiers = append(verifiers, func(cs tls.ConnectionState) error {
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if fingerprint := hex.EncodeToString(sum[:]); fingerprint != pin {
+				return fmt.Errorf("server certificate fingerprint %s does not match the pinned one", fingerprint)
+			}
+			return nil
+		})
+	}
+
+	if len(verifiers) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			for _, verify := range verifiers {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCA reads a CA bundle, refusing ones without certificates
+func loadCA(file string) (*x509.CertPool, error) {
+	cacerts, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(cacerts) {
+		return nil, fmt.Errorf("CA bundle %s contains no PEM certificates", file)
+	}
+
+	return roots, nil
+}
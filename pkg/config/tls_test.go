@@ -0,0 +1,150 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSMode(t *testing.T) {
+	tests := []struct {
+		name string
+		tls  TLS
+		want string
+	}{
+		{"nothing", TLS{}, TLSModeDisabled},
+		{"explicit", TLS{Mode: TLSModeVerify, CA: "ca.pem"}, TLSModeVerify},
+		{"explicit disabled", TLS{Mode: TLSModeDisabled}, TLSModeDisabled},
+		{"ca", TLS{CA: "ca.pem"}, TLSModeCA},
+		{"ca with client cert", TLS{CA: "ca.pem", Cert: "c.pem", Key: "k.pem"}, TLSModeCA},
+		{"ca with server name", TLS{CA: "ca.pem", ServerName: "csi.example.com"}, TLSModeVerify},
+		{"client cert", TLS{Cert: "c.pem", Key: "k.pem"}, TLSModeVerify},
+		{"server name", TLS{ServerName: "csi.example.com"}, TLSModeVerify},
+		{"pin", TLS{PinSHA256: "00"}, TLSModeVerify},
+	}
+
+	for _, tt := range tests {
+		if got := tt.tls.mode(); got != tt.want {
+			t.Errorf("%s: mode() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTLSValidate(t *testing.T) {
+	pin := strings.Repeat("4f", sha256.Size)
+
+	tests := []struct {
+		name    string
+		tls     TLS
+		wantErr bool
+	}{
+		{"disabled", TLS{}, false},
+		{"cert without key", TLS{Cert: "c.pem"}, true},
+		{"key without cert", TLS{Key: "k.pem"}, true},
+		{"disabled with ca", TLS{Mode: TLSModeDisabled, CA: "ca.pem"}, true},
+		{"ca mode without ca", TLS{Mode: TLSModeCA}, true},
+		{"unknown mode", TLS{Mode: "insecure"}, true},
+		{"pin", TLS{PinSHA256: pin}, false},
+		{"pin with colons, upper case", TLS{PinSHA256: "46:81:74:FD:00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF:00:11:22:33:44:55:66:77:88:99:AA:BB"}, false},
+		{"short pin", TLS{PinSHA256: pin[:62]}, true},
+		{"long pin", TLS{PinSHA256: pin + "00"}, true},
+		{"pin not hex", TLS{PinSHA256: "zz" + pin[2:]}, true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.tls.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCA(t, dir)
+
+	empty := path.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("no certificates"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		tls          TLS
+		wantNil      bool
+		wantSkip     bool
+		wantVerifier bool
+		wantErr      bool
+	}{
+		{name: "disabled", tls: TLS{}, wantNil: true},
+		{name: "ca", tls: TLS{CA: ca}, wantSkip: true, wantVerifier: true},
+		{name: "verify", tls: TLS{Mode: TLSModeVerify, CA: ca}},
+		{name: "pinned", tls: TLS{Mode: TLSModeVerify, PinSHA256: "00"}, wantVerifier: true},
+		{name: "missing ca", tls: TLS{CA: path.Join(dir, "missing.pem")}, wantErr: true},
+		{name: "ca without certificates", tls: TLS{CA: empty}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.tls.Config()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Config() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (cfg == nil) != tt.wantNil {
+				t.Fatalf("Config() = %v, want nil: %v", cfg, tt.wantNil)
+			}
+			if cfg == nil {
+				return
+			}
+			if cfg.InsecureSkipVerify != tt.wantSkip {
+				t.Errorf("InsecureSkipVerify = %v, want %v", cfg.InsecureSkipVerify, tt.wantSkip)
+			}
+			if (cfg.VerifyConnection != nil) != tt.wantVerifier {
+				t.Errorf("VerifyConnection set: %v, want %v", cfg.VerifyConnection != nil, tt.wantVerifier)
+			}
+		})
+	}
+}
+
+// writeCA writes a self-signed CA certificate into dir
+func writeCA(t *testing.T, dir string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(dir, "ca.pem")
+	if err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"fmt"
+	"text/template"
+)
+
+// URIData is passed to userspace access URI templates
+type URIData struct {
+	// VolumeID is the CSI volume id
+	VolumeID string
+	// VolumeContext is returned by CreateVolume
+	VolumeContext map[string]string
+	// PublishContext is returned by ControllerPublishVolume
+	PublishContext map[string]string
+}
+
+// ParseURITemplate parses a userspace access URI template. Referring to
+// missing context keys fails evaluation.
+func ParseURITemplate(hypervisor, uri string) (*template.Template, error) {
+	tmpl, err := template.New(hypervisor).Option("missingkey=error").Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s uri template: %w", hypervisor, err)
+	}
+
+	return tmpl, nil
+}
@@ -2,97 +2,271 @@ package csiclient
 
 import (
 	"context"
-	"fmt"
 	"os"
-	"path/filepath"
 
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/blockdev"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
 )
 
 func (c *client) Attach(ctx context.Context, cfg *extstorage.VolumeInfo) error {
-	vol, err := c.store.Get(ctx, cfg.UUID)
+	a, err := c.attach(ctx, cfg)
 	if err != nil {
 		return err
 	}
 
-	if vol == nil {
-		return ErrVolumeNotFound
+	printAttachment(a.dev, a.uris)
+
+	return nil
+}
+
+// attachment is an attached volume
+type attachment struct {
+	// dev is the local block device, empty for userspace-only volumes
+	dev string
+	// uris are the userspace access URIs
+	uris []string
+}
+
+// attach publishes the volume on this node. When a step fails, completed
+// steps are undone, unless the volume has already been attached.
+func (c *client) attach(ctx context.Context, cfg *extstorage.VolumeInfo) (_ *attachment, err error) {
+	vol, d, err := c.volume(ctx, cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	node := csi.NewNodeClient(c.conn)
+	var undo rollback
+	if _, serr := os.Stat(c.devicePath(cfg)); serr != nil {
+		defer func() {
+			if err != nil {
+				err = undo.run(ctx, d.cfg.OperationTimeout("detach"), err)
+			}
+		}()
+	}
+
+	ctrl, err := d.controllerService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctrl.caps.AccessibilityConstraints {
+		if err = d.checkTopology(ctx, vol); err != nil {
+			return nil, err
+		}
+	}
 
 	var pubresp *csi.ControllerPublishVolumeResponse
+	var nodeID string
 
-	if c.controllerPublish {
-		ni, err := node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if ctrl.caps.ControllerPublish {
+		ni, err := d.nodeInfo(ctx)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		nodeID = ni.NodeID
 
-		controller := csi.NewControllerClient(c.conn)
+		secrets, err := d.operationSecrets(config.SecretsControllerPublish)
+		if err != nil {
+			return nil, err
+		}
+
+		controller := csi.NewControllerClient(ctrl.conn)
 		pubresp, err = controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
 			VolumeId:         vol.VolumeId,
-			NodeId:           ni.GetNodeId(),
-			VolumeCapability: volumeCapability,
+			NodeId:           ni.NodeID,
+			VolumeCapability: d.volumeCapability(vol),
 			VolumeContext:    vol.VolumeContext,
+			Secrets:          secrets,
 		})
 		if err != nil {
+			return nil, err
+		}
+
+		undo.add(func(ctx context.Context) error {
+			_, err := controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+				VolumeId: vol.VolumeId,
+				NodeId:   ni.NodeID,
+				Secrets:  secrets,
+			})
 			return err
+		})
+	}
+
+	if d.cfg.UserspaceOnly {
+		// no local block device
+		uris, err := d.userspaceURIs(vol, pubresp.GetPublishContext())
+		if err != nil {
+			return nil, err
 		}
+
+		return &attachment{uris: uris}, nil
 	}
 
-	nodeCaps, err := node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	ns, err := d.nodeService(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var nodeStage bool
-	for _, cap := range nodeCaps.Capabilities {
-		if cap.GetRpc().GetType() == csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME {
-			nodeStage = true
-		}
+	node := csi.NewNodeClient(ns.conn)
+
+	nodeCaps, err := d.nodeCapabilities(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	volPath := volumePath(cfg)
-	os.MkdirAll(volPath, 0o755)
+	if err = c.makeVolumePath(cfg); err != nil {
+		return nil, err
+	}
+	volPath := c.volumePath(cfg)
+	undo.add(removeDir(volPath))
 	var stagingTargetPath string
 
-	if nodeStage {
-		stagingTargetPath = volumeStagingPath(cfg)
-		os.MkdirAll(stagingTargetPath, 0o750)
+	if nodeCaps.StageUnstage {
+		stagingTargetPath = c.volumeStagingPath(cfg)
+		if err = makeDir(stagingTargetPath, 0o750); err != nil {
+			return nil, err
+		}
+		undo.add(removeDir(stagingTargetPath))
+
+		secrets, err := d.operationSecrets(config.SecretsNodeStage)
+		if err != nil {
+			return nil, err
+		}
 
 		_, err = node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
 			VolumeId:          vol.VolumeId,
 			PublishContext:    pubresp.GetPublishContext(),
 			VolumeContext:     vol.VolumeContext,
 			StagingTargetPath: stagingTargetPath,
-			VolumeCapability:  volumeCapability,
+			VolumeCapability:  d.volumeCapability(vol),
+			Secrets:           secrets,
 		})
 
 		if err != nil {
+			return nil, err
+		}
+
+		undo.add(func(ctx context.Context) error {
+			_, err := node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+				VolumeId:          vol.VolumeId,
+				StagingTargetPath: stagingTargetPath,
+			})
 			return err
+		})
+	}
+
+	targetPath := c.devicePath(cfg)
+	if vol.ImageSize > 0 {
+		// mount volumes are published to a directory
+		if err = makeDir(targetPath, 0o750); err != nil {
+			return nil, err
 		}
+		undo.add(removeDir(targetPath))
+	}
+
+	secrets, err := d.operationSecrets(config.SecretsNodePublish)
+	if err != nil {
+		return nil, err
 	}
 
-	targetPath := devicePath(cfg)
 	_, err = node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
 		VolumeId:          vol.VolumeId,
 		PublishContext:    pubresp.GetPublishContext(),
 		StagingTargetPath: stagingTargetPath,
 		TargetPath:        targetPath,
-		VolumeCapability:  volumeCapability,
+		VolumeCapability:  d.volumeCapability(vol),
 		VolumeContext:     vol.VolumeContext,
+		Secrets:           secrets,
 	})
 	if err != nil {
+		return nil, err
+	}
+
+	undo.add(func(ctx context.Context) error {
+		_, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   vol.VolumeId,
+			TargetPath: targetPath,
+		})
 		return err
+	})
+
+	var dev string
+	if vol.ImageSize > 0 {
+		if dev, err = attachImage(c.imagePath(cfg), vol.ImageSize); err == nil {
+			undo.add(func(context.Context) error {
+				return detachImage(c.imagePath(cfg))
+			})
+		}
+	} else {
+		dev, err = d.publishedDevice(ctx, targetPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.expandPending(ctx, cfg, vol, d); err != nil {
+		return nil, err
+	}
+
+	if err = checkDevice(dev, vol); err != nil {
+		return nil, err
+	}
+
+	if err = blockdev.Probe(dev); err != nil {
+		return nil, err
 	}
 
-	rpath, err := filepath.EvalSymlinks(targetPath)
+	// templates may fail on the publish context, which rolls back too
+	uris, err := d.userspaceURIs(vol, pubresp.GetPublishContext())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Println(rpath)
 
-	return nil
+	err = c.saveState(cfg, &attachmentState{
+		Driver:              vol.Driver,
+		VolumeID:            vol.VolumeId,
+		NodeID:              nodeID,
+		ControllerPublished: pubresp != nil,
+		PublishContext:      pubresp.GetPublishContext(),
+		StagingTargetPath:   stagingTargetPath,
+		TargetPath:          targetPath,
+		ImageSize:           vol.ImageSize,
+		Provider:            c.cfg.Attach.Provider,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachment{dev: dev, uris: uris}, nil
+}
+
+// publishedDevice waits for the device published at targetPath to appear,
+// and returns the node to hand to Ganeti
+func (d *driver) publishedDevice(ctx context.Context, targetPath string) (string, error) {
+	wctx, cancel := context.WithTimeout(ctx, d.cfg.Timeouts.Device)
+	defer cancel()
+
+	dev, err := blockdev.Wait(wctx, targetPath)
+	if err != nil {
+		return "", err
+	}
+
+	// multipath maps are set up upon udev events of their paths
+	if d.cfg.Settle {
+		if err = blockdev.Settle(wctx); err != nil {
+			return "", err
+		}
+	}
+
+	return blockdev.Holder(dev)
+}
+
+// removeDir is a rollback step removing a directory created by attach
+func removeDir(dir string) func(context.Context) error {
+	return func(context.Context) error {
+		os.Remove(dir)
+		return nil
+	}
 }
@@ -0,0 +1,168 @@
+package csiclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cacheSchema is the version of cache entries, bumped when their fields
+// change. Entries of other versions are ignored.
+const cacheSchema = 1
+
+// CapabilityCache is a node-local cache of discovered CSI plugin
+// capabilities and node information. Entries are keyed by provider,
+// configured driver, service endpoint, plugin name and vendor version, so
+// upgrading the driver implicitly invalidates them, and providers or drivers
+// running the same plugin against different backends do not share them.
+type CapabilityCache struct {
+	// Dir is the directory holding cache entries
+	Dir string
+	// TTL is the maximum age of an entry
+	TTL time.Duration
+}
+
+// capabilities holds everything discovered about a CSI service. Entries of
+// the controller service fill the controller fields, entries of the node
+// service the node ones.
+type capabilities struct {
+	Schema     int       `json:"schema"`
+	Discovered time.Time `json:"discovered"`
+
+	ControllerService bool `json:"controller_service"`
+	ControllerPublish bool `json:"controller_publish"`
+
+	AccessibilityConstraints bool `json:"accessibility_constraints"`
+
+	// OfflineExpansionOnly is set when volumes can only be expanded while
+	// not published
+	OfflineExpansionOnly bool `json:"offline_expansion_only"`
+
+	// Node capabilities and info are discovered lazily, as controller-only
+	// operations do not need them
+	Node     *nodeCapabilities `json:"node,omitempty"`
+	NodeInfo *nodeInfo         `json:"node_info,omitempty"`
+}
+
+type nodeCapabilities struct {
+	StageUnstage bool `json:"stage_unstage"`
+	Expand       bool `json:"expand"`
+}
+
+type nodeInfo struct {
+	NodeID             string            `json:"node_id"`
+	MaxVolumesPerNode  int64             `json:"max_volumes_per_node,omitempty"`
+	AccessibleTopology map[string]string `json:"accessible_topology,omitempty"`
+}
+
+// Invalidate removes all cached entries
+func (c *CapabilityCache) Invalidate() error {
+	if c == nil || c.Dir == "" {
+		return nil
+	}
+
+	entries, err := filepath.Glob(path.Join(c.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.Remove(entry); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *CapabilityCache) path(key string) string {
+	return path.Join(c.Dir, key+".json")
+}
+
+// load returns a cached entry, or nil when missing, expired or unreadable
+func (c *CapabilityCache) load(key string) *capabilities {
+	if c == nil || c.Dir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+
+	var caps capabilities
+	if err = json.Unmarshal(data, &caps); err != nil || caps.Schema != cacheSchema {
+		return nil
+	}
+
+	if c.TTL > 0 && time.Since(caps.Discovered) > c.TTL {
+		return nil
+	}
+
+	return &caps
+}
+
+// save atomically stores an entry
+func (c *CapabilityCache) save(key string, caps *capabilities) error {
+	if c == nil || c.Dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(c.Dir, 0o750); err != nil {
+		return err
+	}
+
+	caps.Schema = cacheSchema
+	data, err := json.Marshal(caps)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(c.Dir, "."+key+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0o640); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+// cacheKey returns a file name safe key for the provider, configured driver,
+// service endpoint, plugin name and version. Endpoints are hashed, as they
+// may be long and contain any character.
+func cacheKey(provider, driver, endpoint, name, version string) string {
+	sanitize := func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}
+
+	sum := sha256.Sum256([]byte(endpoint))
+
+	return strings.Join([]string{
+		strings.Map(sanitize, provider),
+		strings.Map(sanitize, driver),
+		hex.EncodeToString(sum[:8]),
+		strings.Map(sanitize, name),
+		strings.Map(sanitize, version),
+	}, "_")
+}
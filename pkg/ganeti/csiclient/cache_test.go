@@ -0,0 +1,121 @@
+package csiclient
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	base := cacheKey("csi", "default", "unix:///csi/csi.sock", "csi.example.com", "1.0")
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"provider", cacheKey("csi2", "default", "unix:///csi/csi.sock", "csi.example.com", "1.0")},
+		{"driver", cacheKey("csi", "other", "unix:///csi/csi.sock", "csi.example.com", "1.0")},
+		{"endpoint", cacheKey("csi", "default", "unix:///csi/other.sock", "csi.example.com", "1.0")},
+		{"plugin", cacheKey("csi", "default", "unix:///csi/csi.sock", "other.example.com", "1.0")},
+		{"version", cacheKey("csi", "default", "unix:///csi/csi.sock", "csi.example.com", "1.1")},
+	}
+
+	for _, tt := range tests {
+		if tt.key == base {
+			t.Errorf("keys differing in %s are equal: %s", tt.name, tt.key)
+		}
+	}
+
+	if key := cacheKey("../p", "d/x", "e", "n:1", "v 2"); path.Base(key) != key {
+		t.Errorf("cacheKey() = %q, not a file name", key)
+	}
+}
+
+func TestCapabilityCache(t *testing.T) {
+	write := func(t *testing.T, c *CapabilityCache, key, data string) {
+		if err := os.WriteFile(c.path(key), []byte(data), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		// prepare stores the entry of key, if any
+		prepare func(t *testing.T, c *CapabilityCache)
+		want    bool
+	}{
+		{
+			name: "saved",
+			prepare: func(t *testing.T, c *CapabilityCache) {
+				if err := c.save("key", &capabilities{Discovered: time.Now(), ControllerPublish: true}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: true,
+		},
+		{
+			name:    "missing",
+			prepare: func(t *testing.T, c *CapabilityCache) {},
+		},
+		{
+			name: "expired",
+			prepare: func(t *testing.T, c *CapabilityCache) {
+				if err := c.save("key", &capabilities{Discovered: time.Now().Add(-2 * time.Hour)}); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "other schema",
+			prepare: func(t *testing.T, c *CapabilityCache) {
+				write(t, c, "key", `{"schema":0,"discovered":"`+time.Now().Format(time.RFC3339)+`"}`)
+			},
+		},
+		{
+			name: "unreadable",
+			prepare: func(t *testing.T, c *CapabilityCache) {
+				write(t, c, "key", `{`)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CapabilityCache{Dir: t.TempDir(), TTL: time.Hour}
+			tt.prepare(t, c)
+
+			caps := c.load("key")
+			if (caps != nil) != tt.want {
+				t.Fatalf("load() = %+v, want an entry: %v", caps, tt.want)
+			}
+			if caps != nil && !caps.ControllerPublish {
+				t.Errorf("load() = %+v, lost fields", caps)
+			}
+		})
+	}
+}
+
+func TestCapabilityCacheInvalidate(t *testing.T) {
+	c := &CapabilityCache{Dir: t.TempDir(), TTL: time.Hour}
+	if err := c.save("key", &capabilities{Discovered: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Invalidate(); err != nil {
+		t.Fatal(err)
+	}
+	if caps := c.load("key"); caps != nil {
+		t.Errorf("load() = %+v after Invalidate", caps)
+	}
+}
+
+func TestCapabilityCacheDisabled(t *testing.T) {
+	var c *CapabilityCache
+	if err := c.save("key", &capabilities{}); err != nil {
+		t.Errorf("save() = %v", err)
+	}
+	if caps := c.load("key"); caps != nil {
+		t.Errorf("load() = %+v", caps)
+	}
+}
@@ -0,0 +1,114 @@
+package csiclient
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/blockdev"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
+)
+
+// capacityRange is the range requested for a volume holding size bytes, or
+// an image of size bytes, rounded per the allocation policy of the driver
+func (d *driver) capacityRange(size int64, image bool) *csi.CapacityRange {
+	required := size
+	if image {
+		required = imageCapacity(d.cfg, size)
+	}
+
+	if unit := d.cfg.Allocation.GranularityMiB * mebibytes; unit > 0 {
+		required = (required + unit - 1) / unit * unit
+	}
+
+	if image {
+		// filesystems may be larger than required
+		return &csi.CapacityRange{RequiredBytes: required}
+	}
+
+	return &csi.CapacityRange{
+		RequiredBytes: required,
+		LimitBytes:    required + size*d.cfg.Allocation.OvershootPercent/100,
+	}
+}
+
+// recordedCapacity is the capacity to record for a volume, the requested
+// one when the driver does not report it
+func recordedCapacity(capacity int64, r *csi.CapacityRange) int64 {
+	if capacity == 0 {
+		return r.RequiredBytes
+	}
+
+	return capacity
+}
+
+// checkCapacity validates the capacity reported by the driver against the
+// requested range. Zero denotes unknown capacity.
+func checkCapacity(capacity int64, r *csi.CapacityRange) error {
+	if capacity == 0 {
+		return nil
+	}
+
+	if capacity < r.RequiredBytes {
+		return fmt.Errorf("CSI driver returned capacity of %d bytes, less than the required %d", capacity, r.RequiredBytes)
+	}
+
+	if r.LimitBytes > 0 && capacity > r.LimitBytes {
+		return fmt.Errorf("CSI driver returned capacity of %d bytes, more than the limit of %d", capacity, r.LimitBytes)
+	}
+
+	return nil
+}
+
+// expectedSize is the size of the attached device of the volume, zero if
+// unknown
+func expectedSize(vol *store.Volume) int64 {
+	if vol.ImageSize > 0 {
+		return vol.ImageSize
+	}
+
+	return vol.CapacityBytes
+}
+
+// verifySize checks that the attached device is at least size bytes large
+// after expansion
+func verifySize(dev string, size int64) error {
+	if dev == "" {
+		// userspace-only volumes have no local device
+		return nil
+	}
+
+	actual, err := blockdev.Size(dev)
+	if err != nil {
+		return err
+	}
+
+	if actual < size {
+		return fmt.Errorf("device %s is %d bytes after expansion, expected at least %d", dev, actual, size)
+	}
+
+	return nil
+}
+
+// checkDevice verifies the size of the attached device of the volume. A
+// smaller device than recorded would truncate the disk of the instance.
+func checkDevice(dev string, vol *store.Volume) error {
+	expected := expectedSize(vol)
+	if dev == "" || expected == 0 {
+		return nil
+	}
+
+	size, err := blockdev.Size(dev)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case size < expected:
+		return fmt.Errorf("device %s is %d bytes, smaller than the recorded %d", dev, size, expected)
+	case size > expected:
+		slog.Warn("device is larger than recorded", "device", dev, "size", size, "recorded", expected)
+	}
+
+	return nil
+}
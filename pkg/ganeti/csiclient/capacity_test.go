@@ -0,0 +1,126 @@
+package csiclient
+
+import (
+	"testing"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+)
+
+func TestCapacityRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		granularity int64
+		overshoot   int64
+		overhead    int64
+		size        int64
+		image       bool
+		wantReq     int64
+		wantLimit   int64
+	}{
+		{
+			name:      "exact",
+			size:      10*mebibytes + 1,
+			wantReq:   10*mebibytes + 1,
+			wantLimit: 10*mebibytes + 1,
+		},
+		{
+			name:        "rounded up to granularity",
+			granularity: 4,
+			size:        10 * mebibytes,
+			wantReq:     12 * mebibytes,
+			wantLimit:   12 * mebibytes,
+		},
+		{
+			name:        "multiple of granularity",
+			granularity: 4,
+			size:        8 * mebibytes,
+			wantReq:     8 * mebibytes,
+			wantLimit:   8 * mebibytes,
+		},
+		{
+			name:        "overshoot over the rounded size",
+			granularity: 4,
+			overshoot:   10,
+			size:        10 * mebibytes,
+			wantReq:     12 * mebibytes,
+			wantLimit:   13 * mebibytes,
+		},
+		{
+			name:      "overshoot without granularity",
+			overshoot: 50,
+			size:      10 * mebibytes,
+			wantReq:   10 * mebibytes,
+			wantLimit: 15 * mebibytes,
+		},
+		{
+			name:     "image overhead, no limit",
+			overhead: 5,
+			size:     100 * mebibytes,
+			image:    true,
+			wantReq:  105 * mebibytes,
+		},
+		{
+			name:     "small image rounded to MiB",
+			overhead: 5,
+			size:     1000,
+			image:    true,
+			wantReq:  mebibytes,
+		},
+		{
+			name:        "image rounded to granularity, overshoot ignored",
+			granularity: 4,
+			overshoot:   10,
+			overhead:    5,
+			size:        100 * mebibytes,
+			image:       true,
+			wantReq:     108 * mebibytes,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &driver{cfg: &config.Driver{
+				Allocation: config.Allocation{
+					GranularityMiB:   tt.granularity,
+					OvershootPercent: tt.overshoot,
+				},
+				Mount: config.Mount{OverheadPercent: tt.overhead},
+			}}
+
+			r := d.capacityRange(tt.size, tt.image)
+			if r.RequiredBytes != tt.wantReq || r.LimitBytes != tt.wantLimit {
+				t.Errorf("capacityRange(%d, %v) = [%d, %d], want [%d, %d]", tt.size, tt.image, r.RequiredBytes, r.LimitBytes, tt.wantReq, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestCheckCapacity(t *testing.T) {
+	limited := &csi.CapacityRange{RequiredBytes: 10 * mebibytes, LimitBytes: 12 * mebibytes}
+	unlimited := &csi.CapacityRange{RequiredBytes: 10 * mebibytes}
+
+	tests := []struct {
+		name     string
+		capacity int64
+		r        *csi.CapacityRange
+		wantErr  bool
+	}{
+		{"unknown", 0, limited, false},
+		{"below required", 10*mebibytes - 1, limited, true},
+		{"required", 10 * mebibytes, limited, false},
+		{"within limit", 11 * mebibytes, limited, false},
+		{"limit", 12 * mebibytes, limited, false},
+		{"above limit", 12*mebibytes + 1, limited, true},
+		{"no limit", 100 * mebibytes, unlimited, false},
+		{"below required without limit", mebibytes, unlimited, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkCapacity(tt.capacity, tt.r); (err != nil) != tt.wantErr {
+				t.Errorf("checkCapacity(%d) error = %v, wantErr %v", tt.capacity, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,20 +2,18 @@ package csiclient
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
-	"github.com/dravanet/truenas-csi/pkg/config"
-
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
 )
 
 const mebibytes = 1 << 20
 
 func (c *client) Create(ctx context.Context, cfg *extstorage.VolumeInfo) error {
-	if !c.controllerService {
-		return ErrControllerServiceMissing
-	}
-
 	vol, err := c.store.Get(ctx, cfg.UUID)
 	if err != nil {
 		return err
@@ -25,27 +23,120 @@ func (c *client) Create(ctx context.Context, cfg *extstorage.VolumeInfo) error {
 		return ErrVolumeExists
 	}
 
-	cont := csi.NewControllerClient(c.conn)
+	driverName := cfg.ExtParams[DriverExtParam]
+	if driverName == "" {
+		driverName = c.cfg.DefaultDriver
+	}
+
+	d, err := c.driver(driverName)
+	if err != nil {
+		return err
+	}
+
+	ctrl, err := d.controllerService(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !ctrl.caps.ControllerService {
+		return ErrControllerServiceMissing
+	}
+
+	cont := csi.NewControllerClient(ctrl.conn)
 
 	parameters := make(map[string]string)
-	if cfg.TrueNASCSINasSelector != "" {
-		parameters[config.NasSelector] = cfg.TrueNASCSINasSelector
+	for key, value := range d.cfg.Parameters {
+		parameters[key] = value
+	}
+	for param, key := range d.cfg.ExtParams {
+		if value := cfg.ExtParams[param]; value != "" {
+			parameters[key] = value
+		}
 	}
-	if cfg.TrueNASCSIConfigSelector != "" {
-		parameters[config.ConfigSelector] = cfg.TrueNASCSIConfigSelector
+
+	var requirements *csi.TopologyRequirement
+	if ctrl.caps.AccessibilityConstraints {
+		if requirements, err = d.accessibilityRequirements(ctx, cfg); err != nil {
+			return err
+		}
+	}
+
+	var imageSize int64
+	if d.cfg.AccessType == config.AccessTypeMount {
+		imageSize = cfg.Size * mebibytes
 	}
+
+	capacityRange := d.capacityRange(cfg.Size*mebibytes, imageSize > 0)
+
+	capabilities := []*csi.VolumeCapability{d.volumeCapability(nil)}
+
+	secrets, err := d.operationSecrets(config.SecretsCreateVolume)
+	if err != nil {
+		return err
+	}
+
 	resp, err := cont.CreateVolume(ctx, &csi.CreateVolumeRequest{
-		Name: cfg.UUID,
-		CapacityRange: &csi.CapacityRange{
-			RequiredBytes: cfg.Size * mebibytes,
-			LimitBytes:    cfg.Size * mebibytes,
-		},
-		VolumeCapabilities: []*csi.VolumeCapability{volumeCapability},
-		Parameters:         parameters,
+		Name:                      cfg.UUID,
+		CapacityRange:             capacityRange,
+		VolumeCapabilities:        capabilities,
+		Parameters:                parameters,
+		Secrets:                   secrets,
+		AccessibilityRequirements: requirements,
 	})
 	if err != nil {
 		return err
 	}
+	if resp.GetVolume() == nil {
+		return errors.New("CSI driver returned no volume")
+	}
+
+	err = checkCapacity(resp.Volume.CapacityBytes, capacityRange)
+	if err == nil {
+		err = validateCapabilities(ctx, cont, resp.Volume, capabilities, parameters, secrets)
+	}
+	if err != nil {
+		// do not leave an unusable volume behind
+		deleteSecrets, derr := d.operationSecrets(config.SecretsDeleteVolume)
+		if derr == nil {
+			_, derr = cont.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+				VolumeId: resp.Volume.VolumeId,
+				Secrets:  deleteSecrets,
+			})
+		}
+		if derr != nil {
+			return errors.Join(err, fmt.Errorf("removing volume %s: %w", resp.Volume.VolumeId, derr))
+		}
+
+		return err
+	}
+
+	resp.Volume.CapacityBytes = recordedCapacity(resp.Volume.CapacityBytes, capacityRange)
+
+	return c.store.Add(ctx, cfg.UUID, &store.Volume{
+		Volume:     resp.Volume,
+		Driver:     c.cfg.RecordedDriver(driverName),
+		AccessMode: d.cfg.AccessMode,
+		ImageSize:  imageSize,
+	})
+}
+
+// validateCapabilities checks that the driver confirms the capabilities
+// of a created volume
+func validateCapabilities(ctx context.Context, cont csi.ControllerClient, vol *csi.Volume, capabilities []*csi.VolumeCapability, parameters, secrets map[string]string) error {
+	resp, err := cont.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           vol.VolumeId,
+		VolumeContext:      vol.VolumeContext,
+		VolumeCapabilities: capabilities,
+		Parameters:         parameters,
+		Secrets:            secrets,
+	})
+	if err != nil {
+		return fmt.Errorf("validating volume capabilities: %w", err)
+	}
+
+	if resp.Confirmed == nil {
+		return fmt.Errorf("CSI driver does not support access mode %s: %s", capabilities[0].GetAccessMode().GetMode(), resp.Message)
+	}
 
-	return c.store.Add(ctx, cfg.UUID, resp.Volume)
+	return nil
 }
@@ -2,23 +2,21 @@ package csiclient
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
-	"os"
-	"path"
-	"time"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-
-	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
 )
 
 const (
-	csiStoragePath = "/srv/ganeti/ganeti-extstorage-csi"
+	// DriverExtParam is the ext-param selecting the CSI driver of a new volume
+	DriverExtParam = "csi_driver"
+
+	// maxUpdateAttempts limits re-applying updates of volumes modified
+	// concurrently
+	maxUpdateAttempts = 5
 )
 
 // Common errors
@@ -26,120 +24,115 @@ var (
 	ErrVolumeNotFound           = errors.New("volume not found in store")
 	ErrVolumeExists             = errors.New("volume already exists")
 	ErrControllerServiceMissing = errors.New("controller service missing")
+	ErrConnectTimeout           = errors.New("timed out connecting to CSI driver")
+	ErrNotReady                 = errors.New("timed out waiting for CSI driver to become ready")
+	ErrProviderUnset            = errors.New("extstorage provider unset, the wrapper of the provider must export PROVIDER: run ganeti-extstorage-csi-install for the provider again to update it")
 )
 
-var volumeCapability = &csi.VolumeCapability{
-	AccessType: &csi.VolumeCapability_Block{},
-	AccessMode: &csi.VolumeCapability_AccessMode{
-		Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
-	},
-}
+// New returns a new ganeti-extstorage interface talkint to CSI. Drivers
+// are connected on first use. Volumes are attached in the subdirectory of
+// the provider, so it must be configured.
+func New(cfg *config.Config, store store.Store, cache *CapabilityCache) (extstorage.Interface, error) {
+	if cfg.Attach.Provider == "" {
+		return nil, ErrProviderUnset
+	}
 
-// New returns a new ganeti-extstorage interface talkint to CSI
-func New(endpoint string, tlsConfig *tls.Config, store store.Store) (iface extstorage.Interface, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+	return &client{
+		cfg:     cfg,
+		store:   store,
+		cache:   cache,
+		drivers: make(map[string]*driver),
+		paths:   make(map[string]string),
+	}, nil
+}
 
-	var opts grpc.DialOption
-	if tlsConfig != nil {
-		opts = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
-	} else {
-		opts = grpc.WithInsecure()
+func (c *client) Close(ctx context.Context) error {
+	var errs []error
+	for _, d := range c.drivers {
+		errs = append(errs, d.Close())
 	}
 
-	conn, err := grpc.DialContext(ctx, endpoint, opts)
-	if err != nil {
-		return
-	}
-	defer func() {
-		if err != nil {
-			conn.Close()
-		}
-	}()
+	return errors.Join(errs...)
+}
 
-	ic := csi.NewIdentityClient(conn)
-	ident, err := ic.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
-	if err != nil {
-		return
-	}
+type client struct {
+	cfg   *config.Config
+	store store.Store
+	cache *CapabilityCache
 
-	os.Stderr.WriteString(fmt.Sprintf("CSI Name=%s Version=%s manifest=%+v\n", ident.Name, ident.VendorVersion, ident.Manifest))
+	drivers map[string]*driver
+	// paths are the directories of volumes, by UUID
+	paths map[string]string
+}
 
-	caps, err := ic.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
-	if err != nil {
-		return
+// driver returns the connection to the named driver, the default driver
+// when name is empty
+func (c *client) driver(name string) (*driver, error) {
+	if name == "" {
+		name = c.cfg.DefaultDriver
 	}
 
-	cl := &client{
-		conn:  conn,
-		store: store,
+	if d, ok := c.drivers[name]; ok {
+		return d, nil
 	}
 
-	var volexpansion bool
-
-	for _, cap := range caps.Capabilities {
-		if serv := cap.GetService(); serv != nil {
-			if serv.GetType() == csi.PluginCapability_Service_CONTROLLER_SERVICE {
-				cl.controllerService = true
-			}
-			if serv.GetType() == csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS {
-				err = errors.New("CSI reported VOLUME_ACCESSIBILITY_CONSTRAINTS capability, which is not supported")
-				return
-			}
-		} else if volexp := cap.GetVolumeExpansion(); volexp != nil {
-			switch volexp.GetType() {
-			case csi.PluginCapability_VolumeExpansion_ONLINE, csi.PluginCapability_VolumeExpansion_OFFLINE:
-				volexpansion = true
-			}
-		}
+	cfg, ok := c.cfg.Drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown CSI driver %q", name)
 	}
 
-	if !volexpansion {
-		err = errors.New("CSI does not support volume expansion")
-		return
+	d, err := newDriver(name, c.cfg.Attach.Provider, cfg, &c.cfg.Retry, c.cache)
+	if err != nil {
+		return nil, err
 	}
+	c.drivers[name] = d
 
-	if cl.controllerService {
-		var controllerCaps *csi.ControllerGetCapabilitiesResponse
-
-		controller := csi.NewControllerClient(conn)
-		controllerCaps, err = controller.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
-		if err != nil {
-			return
-		}
+	return d, nil
+}
 
-		for _, cap := range controllerCaps.Capabilities {
-			switch cap.GetRpc().GetType() {
-			case csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME:
-				cl.controllerPublish = true
-			}
-		}
+// volume returns the stored volume and the driver serving it
+func (c *client) volume(ctx context.Context, cfg *extstorage.VolumeInfo) (*store.Volume, *driver, error) {
+	vol, err := c.store.Get(ctx, cfg.UUID)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return cl, nil
-}
+	c.reconcile(cfg, vol)
 
-func (c *client) Close(ctx context.Context) error {
-	return c.conn.Close()
-}
+	if vol == nil {
+		return nil, nil, ErrVolumeNotFound
+	}
 
-type client struct {
-	conn  *grpc.ClientConn
-	store store.Store
+	d, err := c.driver(vol.Driver)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	controllerService bool
-	controllerPublish bool
+	return vol, d, nil
 }
 
-// CSIVolumePath returns the target path for a volume
-func volumePath(vol *extstorage.VolumeInfo) string {
-	return path.Join(csiStoragePath, vol.UUID)
-}
+// updateVolume applies modify to the volume and stores it. When the record
+// has been modified concurrently, e.g. by an operation on another node, it
+// is read again and modify re-applied. modify returns false when there is
+// nothing to update.
+func (c *client) updateVolume(ctx context.Context, uuid string, vol *store.Volume, modify func(vol *store.Volume) bool) error {
+	for attempt := 1; ; attempt++ {
+		if !modify(vol) {
+			return nil
+		}
 
-func devicePath(vol *extstorage.VolumeInfo) string {
-	return path.Join(volumePath(vol), "device")
-}
+		err := c.store.Update(ctx, uuid, vol)
+		if !errors.Is(err, store.ErrConflict) || attempt == maxUpdateAttempts {
+			return err
+		}
 
-func volumeStagingPath(vol *extstorage.VolumeInfo) string {
-	return path.Join(volumePath(vol), "staging")
+		fresh, err := c.store.Get(ctx, uuid)
+		if err != nil {
+			return err
+		}
+		if fresh == nil {
+			return store.ErrNotFound
+		}
+		*vol = *fresh
+	}
 }
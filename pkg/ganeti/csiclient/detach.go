@@ -4,74 +4,116 @@ import (
 	"context"
 	"os"
 
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
 )
 
 func (c *client) Detach(ctx context.Context, cfg *extstorage.VolumeInfo) error {
-	vol, err := c.store.Get(ctx, cfg.UUID)
+	vol, d, state, err := c.volumeOrState(ctx, cfg)
 	if err != nil {
 		return err
 	}
 
-	if vol == nil {
-		return ErrVolumeNotFound
-	}
+	// The node is torn down first, not depending on a remote controller.
+	// Userspace-only volumes have not been published on the node.
+	if !d.cfg.UserspaceOnly {
+		ns, err := d.nodeService(ctx)
+		if err != nil {
+			return err
+		}
 
-	node := csi.NewNodeClient(c.conn)
+		node := csi.NewNodeClient(ns.conn)
 
-	nodeCaps, err := node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
-	if err != nil {
-		return err
-	}
-
-	var nodeStage bool
-	for _, cap := range nodeCaps.Capabilities {
-		if cap.GetRpc().GetType() == csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME {
-			nodeStage = true
+		nodeCaps, err := d.nodeCapabilities(ctx)
+		if err != nil {
+			return err
 		}
-	}
 
-	_, err = node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
-		VolumeId:   vol.VolumeId,
-		TargetPath: devicePath(cfg),
-	})
-	if err != nil {
-		return err
-	}
-
-	if nodeStage {
-		stagingTargetPath := volumeStagingPath(cfg)
+		if vol.ImageSize > 0 {
+			if err = detachImage(c.imagePath(cfg)); err != nil {
+				return err
+			}
+		}
 
-		_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
-			VolumeId:          vol.VolumeId,
-			StagingTargetPath: stagingTargetPath,
+		_, err = node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   vol.VolumeId,
+			TargetPath: c.devicePath(cfg),
 		})
-
 		if err != nil {
 			return err
 		}
 
-		os.Remove(stagingTargetPath)
+		if vol.ImageSize > 0 {
+			os.Remove(c.devicePath(cfg))
+		}
+
+		if nodeCaps.StageUnstage {
+			stagingTargetPath := c.volumeStagingPath(cfg)
+
+			_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+				VolumeId:          vol.VolumeId,
+				StagingTargetPath: stagingTargetPath,
+			})
+
+			if err != nil {
+				return err
+			}
+
+			os.Remove(stagingTargetPath)
+		}
 	}
 
-	os.Remove(volumePath(cfg))
+	// the node-local state tells whether the controller published the volume
+	if state != nil && !state.ControllerPublished {
+		return c.removeVolumePath(cfg, d)
+	}
 
-	if c.controllerPublish {
-		ni, err := node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	ctrl, err := d.controllerService(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ctrl.caps.ControllerPublish {
+		// the node ID the volume has been published to
+		var nodeID string
+		if state != nil {
+			nodeID = state.NodeID
+		}
+		if nodeID == "" {
+			ni, err := d.nodeInfo(ctx)
+			if err != nil {
+				return err
+			}
+			nodeID = ni.NodeID
+		}
+
+		secrets, err := d.operationSecrets(config.SecretsControllerPublish)
 		if err != nil {
 			return err
 		}
 
-		controller := csi.NewControllerClient(c.conn)
+		controller := csi.NewControllerClient(ctrl.conn)
 		_, err = controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
 			VolumeId: vol.VolumeId,
-			NodeId:   ni.GetNodeId(),
+			NodeId:   nodeID,
+			Secrets:  secrets,
 		})
 		if err != nil {
 			return err
 		}
 	}
 
+	return c.removeVolumePath(cfg, d)
+}
+
+// removeVolumePath removes the node-local state and the directory of a
+// detached volume
+func (c *client) removeVolumePath(cfg *extstorage.VolumeInfo, d *driver) error {
+	if !d.cfg.UserspaceOnly {
+		os.Remove(c.statePath(cfg))
+		os.Remove(c.volumePath(cfg))
+	}
+
 	return nil
 }
@@ -0,0 +1,376 @@
+package csiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/logging"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/metrics"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/retry"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/tracing"
+)
+
+// driver talks to a configured CSI driver. Its controller and node services
+// may be served on different endpoints, each is connected on first use.
+type driver struct {
+	name string
+	// provider is the extstorage provider the driver serves
+	provider string
+
+	cfg   *config.Driver
+	retry *config.Retry
+	// secrets loaded by operation
+	secrets map[string]map[string]string
+
+	cache *CapabilityCache
+
+	// connections by endpoint, shared by services served on the same one
+	conns map[string]*grpc.ClientConn
+
+	controller *service
+	node       *service
+}
+
+// service is a connection to a CSI service with its capabilities
+type service struct {
+	conn     *grpc.ClientConn
+	cacheKey string
+	caps     *capabilities
+}
+
+func newDriver(name, provider string, cfg *config.Driver, retries *config.Retry, cache *CapabilityCache) (*driver, error) {
+	return &driver{
+		name:     name,
+		provider: provider,
+		cfg:      cfg,
+		retry:    retries,
+		secrets:  make(map[string]map[string]string),
+		cache:    cache,
+		conns:    make(map[string]*grpc.ClientConn),
+	}, nil
+}
+
+// operationSecrets returns the secrets of a CSI operation, loaded on first
+// use. They must not be logged or stored.
+func (d *driver) operationSecrets(op string) (map[string]string, error) {
+	if secrets, ok := d.secrets[op]; ok {
+		return secrets, nil
+	}
+
+	secrets, err := d.cfg.Secrets.Source(op).Load()
+	if err != nil {
+		return nil, fmt.Errorf("loading %s secrets of CSI driver %s: %w", op, d.name, err)
+	}
+	d.secrets[op] = secrets
+
+	return secrets, nil
+}
+
+// volumeCapability returns the capability of a volume. Stored volumes keep
+// the access mode and type they have been created with, new ones (nil)
+// get the configured ones.
+func (d *driver) volumeCapability(vol *store.Volume) *csi.VolumeCapability {
+	mode := d.cfg.Mode()
+	mount := d.cfg.AccessType == config.AccessTypeMount
+
+	if vol != nil {
+		if vol.AccessMode != "" {
+			mode = csi.VolumeCapability_AccessMode_Mode(csi.VolumeCapability_AccessMode_Mode_value[vol.AccessMode])
+		}
+		mount = vol.ImageSize > 0
+	}
+
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: mode,
+		},
+	}
+
+	if mount {
+		capability.AccessType = &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{
+				FsType:     d.cfg.Mount.FsType,
+				MountFlags: d.cfg.Mount.MountFlags,
+			},
+		}
+	}
+
+	return capability
+}
+
+func (d *driver) Close() error {
+	var errs []error
+	for _, conn := range d.conns {
+		errs = append(errs, conn.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// dial returns a connection to the endpoint of a service
+func (d *driver) dial(ctx context.Context, svc config.Service) (*grpc.ClientConn, error) {
+	if conn, ok := d.conns[svc.Endpoint]; ok {
+		return conn, nil
+	}
+
+	tlsConfig, err := svc.TLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("preparing tls configuration for csi: %w", err)
+	}
+
+	var opts grpc.DialOption
+	if tlsConfig != nil {
+		opts = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	} else {
+		opts = grpc.WithInsecure()
+	}
+
+	// retries are outermost, so each attempt is logged and measured
+	conn, err := grpc.DialContext(ctx, svc.Endpoint, opts, tracing.DialOption(), grpc.WithChainUnaryInterceptor(
+		retry.UnaryClientInterceptor(d.retry),
+		logging.UnaryClientInterceptor("csi"),
+		metrics.UnaryClientInterceptor(),
+	))
+	if err != nil {
+		return nil, err
+	}
+	d.conns[svc.Endpoint] = conn
+
+	return conn, nil
+}
+
+// connectError marks errors caused by exceeding the connect timeout
+func (d *driver) connectError(ctx context.Context, kind string, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %s service of %s within %s: %v", ErrConnectTimeout, kind, d.name, d.cfg.Timeouts.Connect, err)
+	}
+
+	return err
+}
+
+// connect connects to a service, and loads its cached capabilities. kind
+// distinguishes cache entries of services.
+func (d *driver) connect(ctx context.Context, svc config.Service, kind string) (*service, error) {
+	conn, err := d.dial(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	ic := csi.NewIdentityClient(conn)
+	ident, err := ic.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("%s service: %w", kind, err)
+	}
+
+	slog.InfoContext(ctx, "connected to CSI plugin", "driver", d.name, "service", kind, "name", ident.Name, "version", ident.VendorVersion, "manifest", ident.Manifest)
+
+	s := &service{
+		conn:     conn,
+		cacheKey: cacheKey(d.provider, d.name, svc.Endpoint, ident.Name, ident.VendorVersion) + "_" + kind,
+	}
+	s.caps = d.cache.load(s.cacheKey)
+
+	return s, nil
+}
+
+// controllerService returns the controller service, discovering its
+// capabilities unless cached
+func (d *driver) controllerService(ctx context.Context) (*service, error) {
+	if d.controller != nil {
+		return d.controller, nil
+	}
+
+	if err := d.waitReady(ctx, d.cfg.ControllerService(), "controller"); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeouts.Connect)
+	defer cancel()
+
+	s, err := d.connect(ctx, d.cfg.ControllerService(), "controller")
+	if err != nil {
+		return nil, d.connectError(ctx, "controller", err)
+	}
+
+	if s.caps == nil {
+		if s.caps, err = discoverCapabilities(ctx, s.conn); err != nil {
+			return nil, d.connectError(ctx, "controller", err)
+		}
+		d.saveCapabilities(s)
+	}
+	d.controller = s
+
+	return s, nil
+}
+
+// nodeService returns the node service. Its capabilities are discovered
+// lazily, see nodeCapabilities and nodeInfo.
+func (d *driver) nodeService(ctx context.Context) (*service, error) {
+	if d.node != nil {
+		return d.node, nil
+	}
+
+	if err := d.waitReady(ctx, d.cfg.NodeService(), "node"); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeouts.Connect)
+	defer cancel()
+
+	s, err := d.connect(ctx, d.cfg.NodeService(), "node")
+	if err != nil {
+		return nil, d.connectError(ctx, "node", err)
+	}
+
+	if s.caps == nil {
+		s.caps = &capabilities{
+			Discovered: time.Now(),
+		}
+	}
+	d.node = s
+
+	return s, nil
+}
+
+// discoverCapabilities queries identity and controller capabilities
+func discoverCapabilities(ctx context.Context, conn *grpc.ClientConn) (*capabilities, error) {
+	ic := csi.NewIdentityClient(conn)
+	caps, err := ic.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	discovered := &capabilities{
+		Discovered: time.Now(),
+	}
+
+	var online, offline bool
+
+	for _, cap := range caps.Capabilities {
+		if serv := cap.GetService(); serv != nil {
+			if serv.GetType() == csi.PluginCapability_Service_CONTROLLER_SERVICE {
+				discovered.ControllerService = true
+			}
+			if serv.GetType() == csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS {
+				discovered.AccessibilityConstraints = true
+			}
+		} else if volexp := cap.GetVolumeExpansion(); volexp != nil {
+			switch volexp.GetType() {
+			case csi.PluginCapability_VolumeExpansion_ONLINE:
+				online = true
+			case csi.PluginCapability_VolumeExpansion_OFFLINE:
+				offline = true
+			}
+		}
+	}
+
+	if !online && !offline {
+		return nil, errors.New("CSI does not support volume expansion")
+	}
+	discovered.OfflineExpansionOnly = !online
+
+	if discovered.ControllerService {
+		controller := csi.NewControllerClient(conn)
+		controllerCaps, err := controller.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cap := range controllerCaps.Capabilities {
+			switch cap.GetRpc().GetType() {
+			case csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME:
+				discovered.ControllerPublish = true
+			}
+		}
+	}
+
+	return discovered, nil
+}
+
+// saveCapabilities stores discovered capabilities in the cache. Failing to
+// do so only costs a rediscovery next time, hence errors are just reported.
+func (d *driver) saveCapabilities(s *service) {
+	if err := d.cache.save(s.cacheKey, s.caps); err != nil {
+		slog.Warn("failed saving capability cache", "error", err)
+	}
+}
+
+// nodeCapabilities returns node service capabilities, querying the plugin
+// only when they are not cached yet
+func (d *driver) nodeCapabilities(ctx context.Context) (*nodeCapabilities, error) {
+	s, err := d.nodeService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.caps.Node != nil {
+		return s.caps.Node, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeouts.Connect)
+	defer cancel()
+
+	node := csi.NewNodeClient(s.conn)
+	nodeCaps, err := node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		return nil, d.connectError(ctx, "node", err)
+	}
+
+	discovered := &nodeCapabilities{}
+	for _, cap := range nodeCaps.Capabilities {
+		switch cap.GetRpc().GetType() {
+		case csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME:
+			discovered.StageUnstage = true
+		case csi.NodeServiceCapability_RPC_EXPAND_VOLUME:
+			discovered.Expand = true
+		}
+	}
+
+	s.caps.Node = discovered
+	d.saveCapabilities(s)
+
+	return discovered, nil
+}
+
+// nodeInfo returns NodeGetInfo results, querying the plugin only when they
+// are not cached yet
+func (d *driver) nodeInfo(ctx context.Context) (*nodeInfo, error) {
+	s, err := d.nodeService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.caps.NodeInfo != nil {
+		return s.caps.NodeInfo, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeouts.Connect)
+	defer cancel()
+
+	node := csi.NewNodeClient(s.conn)
+	ni, err := node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil {
+		return nil, d.connectError(ctx, "node", err)
+	}
+
+	discovered := &nodeInfo{
+		NodeID:             ni.GetNodeId(),
+		MaxVolumesPerNode:  ni.GetMaxVolumesPerNode(),
+		AccessibleTopology: ni.GetAccessibleTopology().GetSegments(),
+	}
+
+	s.caps.NodeInfo = discovered
+	d.saveCapabilities(s)
+
+	return discovered, nil
+}
@@ -0,0 +1,88 @@
+package csiclient
+
+import (
+	"context"
+	"os"
+	"slices"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
+)
+
+// expandPending carries out a pending node expansion of the volume, when it
+// is attached on this node and the node has not done so yet. The node is
+// recorded unless a later grow superseded the expansion meanwhile. It runs
+// on attach, open and grow only, metadata operations such as setinfo and
+// close do not depend on the node service.
+func (c *client) expandPending(ctx context.Context, cfg *extstorage.VolumeInfo, vol *store.Volume, d *driver) error {
+	if vol.NodeExpansion == nil {
+		return nil
+	}
+
+	// Only volumes attached here are expanded, the node service might not
+	// even run on this node otherwise
+	if _, err := os.Stat(c.devicePath(cfg)); err != nil {
+		return nil
+	}
+
+	ni, err := d.nodeInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(vol.NodeExpansion.Nodes, ni.NodeID) {
+		return nil
+	}
+
+	capacity := vol.NodeExpansion.CapacityBytes
+	if err = c.nodeExpand(ctx, cfg, vol, d, capacity); err != nil {
+		return err
+	}
+
+	return c.updateVolume(ctx, cfg.UUID, vol, func(vol *store.Volume) bool {
+		if vol.NodeExpansion == nil || vol.NodeExpansion.CapacityBytes != capacity || slices.Contains(vol.NodeExpansion.Nodes, ni.NodeID) {
+			return false
+		}
+		vol.NodeExpansion.Nodes = append(vol.NodeExpansion.Nodes, ni.NodeID)
+
+		return true
+	})
+}
+
+// nodeExpand expands the volume attached on this node, and its image
+func (c *client) nodeExpand(ctx context.Context, cfg *extstorage.VolumeInfo, vol *store.Volume, d *driver, capacity int64) error {
+	nodeCaps, err := d.nodeCapabilities(ctx)
+	if err != nil {
+		return err
+	}
+
+	if nodeCaps.Expand {
+		ns, err := d.nodeService(ctx)
+		if err != nil {
+			return err
+		}
+
+		req := &csi.NodeExpandVolumeRequest{
+			VolumeId:         vol.VolumeId,
+			VolumePath:       c.devicePath(cfg),
+			CapacityRange:    &csi.CapacityRange{RequiredBytes: capacity},
+			VolumeCapability: d.volumeCapability(vol),
+		}
+		if nodeCaps.StageUnstage {
+			req.StagingTargetPath = c.volumeStagingPath(cfg)
+		}
+
+		node := csi.NewNodeClient(ns.conn)
+		if _, err = node.NodeExpandVolume(ctx, req); err != nil {
+			return err
+		}
+	}
+
+	// the filesystem has been grown above, the image may follow
+	if vol.ImageSize > 0 {
+		return growImage(c.imagePath(cfg), vol.ImageSize)
+	}
+
+	return nil
+}
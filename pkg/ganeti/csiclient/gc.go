@@ -0,0 +1,299 @@
+package csiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/blockdev"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/loop"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/mountinfo"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
+)
+
+// volumeDirEntries are the entries attach creates in the directory of a
+// volume
+var volumeDirEntries = []string{"device", "staging", stateName, stateName + ".tmp"}
+
+// instanceDisksDir holds the links Ganeti keeps to the disks of instances
+// activated on this node
+const instanceDisksDir = "/var/run/ganeti/instance-disks"
+
+// GC cleans up attachments left behind on this node by failed or
+// interrupted detaches: directories of volumes not published, removed from
+// the store, or published but held open by neither a process nor an
+// activated instance disk. Leftovers are unpublished, unstaged and removed
+// with confirm, only reported otherwise. Only the subdirectory of the
+// provider is scanned, so it must be configured.
+func GC(ctx context.Context, cfg *config.Config, st store.Store, cache *CapabilityCache, confirm bool) error {
+	if cfg.Attach.Provider == "" {
+		return ErrProviderUnset
+	}
+
+	c := &client{
+		cfg:     cfg,
+		store:   st,
+		cache:   cache,
+		drivers: make(map[string]*driver),
+		paths:   make(map[string]string),
+	}
+	defer c.Close(ctx)
+
+	root := path.Join(cfg.Attach.Dir, cfg.Attach.Provider)
+
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	mounts, err := mountinfo.Read()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		vol := &extstorage.VolumeInfo{UUID: entry.Name()}
+		// the former layout is not collected
+		c.paths[vol.UUID] = path.Join(root, vol.UUID)
+
+		if err = c.collect(ctx, vol, mounts, confirm); err != nil {
+			errs = append(errs, fmt.Errorf("volume %s: %w", vol.UUID, err))
+		}
+	}
+
+	if confirm {
+		errs = append(errs, c.reconcileDetached(ctx, root))
+	}
+
+	return errors.Join(errs...)
+}
+
+// collect cleans up the directory of a volume, unless it is an active
+// attachment: its device is held open by a process, e.g. a running
+// instance, or linked as the disk of an activated instance
+func (c *client) collect(ctx context.Context, vol *extstorage.VolumeInfo, mounts []mountinfo.Mount, confirm bool) error {
+	volPath := c.volumePath(vol)
+	log := slog.With("vol_uuid", vol.UUID, "path", volPath)
+
+	entries, err := os.ReadDir(volPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !slices.Contains(volumeDirEntries, entry.Name()) {
+			log.Info("not a volume directory, skipping")
+			return nil
+		}
+	}
+
+	// attaches still running must not be disturbed
+	fi, err := os.Stat(volPath)
+	if err != nil {
+		return err
+	}
+	if time.Since(fi.ModTime()) < c.cfg.OperationTimeout("attach") {
+		log.Debug("recently attached, skipping")
+		return nil
+	}
+
+	stored, err := c.store.Get(ctx, vol.UUID)
+	if err != nil {
+		return fmt.Errorf("cross-checking the store: %w", err)
+	}
+
+	dev, err := c.localDevice(vol)
+	if err != nil {
+		return err
+	}
+	var pids []int
+	if dev != "" {
+		if pids, err = deviceUsers(dev); err != nil {
+			log.Warn("failed finding users of the attachment, skipping", "device", dev, "error", err)
+			return nil
+		}
+	}
+
+	disk, err := instanceDisk(c.devicePath(vol), dev)
+	if err != nil {
+		log.Warn("failed finding instance disks of the attachment, skipping", "error", err)
+		return nil
+	}
+
+	if len(pids) > 0 || disk != "" {
+		if stored == nil {
+			log.Warn("attachment of a volume missing from the store in use, skipping", "device", dev, "pids", pids, "instance_disk", disk)
+		}
+		return nil
+	}
+
+	mounted := mountinfo.Under(mounts, volPath)
+
+	var mountPoints []string
+	for _, m := range mounted {
+		mountPoints = append(mountPoints, m.MountPoint)
+	}
+	log.Info("stale attachment", "stored", stored != nil, "published", c.published(vol, mounted), "mounts", mountPoints, "device", dev)
+
+	if !confirm {
+		return nil
+	}
+
+	if len(mounted) > 0 || dev != "" {
+		state, err := c.loadState(vol)
+		if err != nil {
+			return err
+		}
+
+		if stored == nil && state == nil {
+			return fmt.Errorf("volume unknown to the store and without node-local state, unmount %s manually", strings.Join(mountPoints, ", "))
+		}
+
+		if err = c.Detach(ctx, vol); err != nil {
+			return err
+		}
+	}
+
+	os.Remove(c.statePath(vol))
+	os.Remove(c.statePath(vol) + ".tmp")
+	os.Remove(c.volumeStagingPath(vol))
+	os.Remove(c.devicePath(vol))
+	if err = os.Remove(volPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Info("stale attachment removed")
+
+	return nil
+}
+
+// published tells whether the volume is published on this node
+func (c *client) published(vol *extstorage.VolumeInfo, mounted []mountinfo.Mount) bool {
+	devPath := c.devicePath(vol)
+	if slices.ContainsFunc(mounted, func(m mountinfo.Mount) bool { return m.MountPoint == devPath }) {
+		return true
+	}
+
+	// drivers may link to the device instead of mounting it
+	fi, err := os.Lstat(devPath)
+
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+// localDevice returns the device of a volume left on this node, the loop
+// device of its image or its published device node
+func (c *client) localDevice(vol *extstorage.VolumeInfo) (string, error) {
+	if dev, err := loop.Find(c.imagePath(vol)); err != nil || dev != "" {
+		return dev, err
+	}
+
+	devPath := c.devicePath(vol)
+	if fi, err := os.Stat(devPath); err == nil && fi.Mode()&os.ModeDevice != 0 {
+		return devPath, nil
+	}
+
+	return "", nil
+}
+
+// instanceDisk returns the instance disk link of Ganeti pointing to one of
+// paths, or "" when there is none
+func instanceDisk(paths ...string) (string, error) {
+	entries, err := os.ReadDir(instanceDisksDir)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var targets []string
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		targets = append(targets, p)
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			targets = append(targets, resolved)
+		}
+	}
+
+	for _, entry := range entries {
+		link := path.Join(instanceDisksDir, entry.Name())
+
+		target, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		resolved, _ := filepath.EvalSymlinks(link)
+
+		if slices.Contains(targets, target) || slices.Contains(targets, resolved) {
+			return entry.Name(), nil
+		}
+	}
+
+	return "", nil
+}
+
+// deviceUsers returns the processes holding the device or its multipath
+// map open
+func deviceUsers(dev string) ([]int, error) {
+	pids, err := blockdev.Users(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	holder, err := blockdev.Holder(dev)
+	if err != nil || holder == dev {
+		return pids, err
+	}
+
+	holderPids, err := blockdev.Users(holder)
+
+	return append(pids, holderPids...), err
+}
+
+// reconcileDetached reconciles volumes detached while the store was
+// unreachable
+func (c *client) reconcileDetached(ctx context.Context, root string) error {
+	entries, err := os.ReadDir(path.Join(root, detachedDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		uuid, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		stored, err := c.store.Get(ctx, uuid)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("volume %s: %w", uuid, err))
+			continue
+		}
+
+		c.reconcile(&extstorage.VolumeInfo{UUID: uuid}, stored)
+	}
+
+	return errors.Join(errs...)
+}
@@ -2,75 +2,156 @@ package csiclient
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
 )
 
 func (c *client) Grow(ctx context.Context, cfg *extstorage.VolumeInfo) error {
-	if !c.controllerService {
-		return ErrControllerServiceMissing
+	vol, d, err := c.volume(ctx, cfg)
+	if err != nil {
+		return err
 	}
 
-	vol, err := c.store.Get(ctx, cfg.UUID)
+	ctrl, err := d.controllerService(ctx)
 	if err != nil {
 		return err
 	}
 
-	if vol == nil {
-		return ErrVolumeNotFound
+	if !ctrl.caps.ControllerService {
+		return ErrControllerServiceMissing
 	}
 
-	cont := csi.NewControllerClient(c.conn)
+	_, err = os.Stat(c.devicePath(cfg))
+	attached := err == nil
 
-	_, err = cont.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
-		VolumeId: vol.VolumeId,
-		CapacityRange: &csi.CapacityRange{
-			RequiredBytes: cfg.NewSize * mebibytes,
-			LimitBytes:    cfg.NewSize * mebibytes,
-		},
-		VolumeCapability: volumeCapability,
-	})
+	capacityRange := d.capacityRange(cfg.NewSize*mebibytes, vol.ImageSize > 0)
+
+	// Volumes rounded up upon allocation may already be large enough
+	if vol.CapacityBytes >= capacityRange.RequiredBytes {
+		return c.growRecorded(ctx, cfg, vol, attached)
+	}
+
+	// Drivers expanding offline only reject or mishandle published volumes
+	cycle := false
+	if ctrl.caps.OfflineExpansionOnly && attached {
+		if d.cfg.OfflineExpansion != config.OfflineExpansionCycle {
+			return fmt.Errorf("CSI driver %s supports offline expansion only, and volume %s is attached on this node: shut down the instance before growing, or set offlineExpansion: %s for the driver", d.name, cfg.Name, config.OfflineExpansionCycle)
+		}
+
+		if err = c.Detach(ctx, cfg); err != nil {
+			return fmt.Errorf("detaching for offline expansion: %w", err)
+		}
+		cycle = true
+	}
+
+	if err = c.expand(ctx, cfg, vol, d, ctrl, capacityRange); err != nil {
+		if cycle {
+			if _, aerr := c.attach(ctx, cfg); aerr != nil {
+				return errors.Join(err, fmt.Errorf("re-attaching: %w", aerr))
+			}
+		}
+
+		return err
+	}
+
+	size := cfg.NewSize * mebibytes
+
+	if cycle {
+		// node expansion and the image are handled upon attach
+		a, err := c.attach(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("re-attaching after offline expansion: %w", err)
+		}
+
+		return verifySize(a.dev, size)
+	}
+
+	if vol.NodeExpansion != nil {
+		err = c.expandPending(ctx, cfg, vol, d)
+	} else if attached && vol.ImageSize > 0 {
+		// Without node expansion, only the image of an attached volume is
+		// grown
+		err = growImage(c.imagePath(cfg), vol.ImageSize)
+	}
+	if err != nil || !attached {
+		return err
+	}
+
+	dev, err := c.localDevice(cfg)
 	if err != nil {
 		return err
 	}
 
-	node := csi.NewNodeClient(c.conn)
+	return verifySize(dev, size)
+}
+
+// growRecorded grows a volume already allocated large enough, only its
+// image needs to follow
+func (c *client) growRecorded(ctx context.Context, cfg *extstorage.VolumeInfo, vol *store.Volume, attached bool) error {
+	if vol.ImageSize == 0 {
+		return nil
+	}
 
-	nodeCaps, err := node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	err := c.updateVolume(ctx, cfg.UUID, vol, func(vol *store.Volume) bool {
+		vol.ImageSize = cfg.NewSize * mebibytes
+		return true
+	})
 	if err != nil {
 		return err
 	}
 
-	var nodeStage bool
-	var nodeExpand bool
-	for _, cap := range nodeCaps.Capabilities {
-		switch cap.GetRpc().GetType() {
-		case csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME:
-			nodeStage = true
-		case csi.NodeServiceCapability_RPC_EXPAND_VOLUME:
-			nodeExpand = true
-		}
+	if attached {
+		return growImage(c.imagePath(cfg), vol.ImageSize)
 	}
 
-	// nothing to be done
-	if !nodeStage || !nodeExpand {
-		return nil
+	return nil
+}
+
+// expand expands the volume on the controller, and records the new size
+func (c *client) expand(ctx context.Context, cfg *extstorage.VolumeInfo, vol *store.Volume, d *driver, ctrl *service, capacityRange *csi.CapacityRange) error {
+	cont := csi.NewControllerClient(ctrl.conn)
+
+	secrets, err := d.operationSecrets(config.SecretsControllerExpand)
+	if err != nil {
+		return err
 	}
 
-	// Check if volume has already been attached
-	volumePath := devicePath(cfg)
-	if _, err := os.Stat(volumePath); err != nil {
-		return nil
+	resp, err := cont.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:         vol.VolumeId,
+		CapacityRange:    capacityRange,
+		VolumeCapability: d.volumeCapability(vol),
+		Secrets:          secrets,
+	})
+	if err != nil {
+		return err
 	}
 
-	_, err = node.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
-		VolumeId:          vol.VolumeId,
-		VolumePath:        volumePath,
-		StagingTargetPath: volumeStagingPath(cfg),
-		VolumeCapability:  volumeCapability,
+	// the volume has been expanded, record it even when its capacity is off
+	err = c.updateVolume(ctx, cfg.UUID, vol, func(vol *store.Volume) bool {
+		vol.CapacityBytes = recordedCapacity(resp.CapacityBytes, capacityRange)
+
+		if vol.ImageSize > 0 {
+			// images are grown upon attach on nodes not attached now
+			vol.ImageSize = cfg.NewSize * mebibytes
+		}
+
+		// Nodes the volume is attached to expand it the next time an
+		// operation runs there, this one right away
+		vol.NodeExpansion = nil
+		if resp.NodeExpansionRequired {
+			vol.NodeExpansion = &store.NodeExpansion{
+				CapacityBytes: vol.CapacityBytes,
+			}
+		}
+
+		return true
 	})
 
-	return err
+	return errors.Join(err, checkCapacity(resp.CapacityBytes, capacityRange))
 }
@@ -0,0 +1,88 @@
+package csiclient
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/loop"
+)
+
+// Filesystem-only drivers publish mount volumes. Such volumes hold a sparse
+// image file exposed through a loop device.
+
+const imageName = "disk.img"
+
+// imageCapacity returns the capacity requested for a volume holding an image
+// of the given size, rounded up to mebibytes
+func imageCapacity(cfg *config.Driver, imageSize int64) int64 {
+	capacity := imageSize + imageSize*cfg.Mount.OverheadPercent/100
+
+	return (capacity + mebibytes - 1) / mebibytes * mebibytes
+}
+
+// attachImage creates the image file of the published volume unless it
+// exists, grows it when smaller than size, then sets up its loop device
+func attachImage(image string, size int64) (string, error) {
+	f, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return "", err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+
+	if st.Size() < size {
+		// sparse, blocks are allocated upon writes
+		if err = f.Truncate(size); err != nil {
+			f.Close()
+			return "", fmt.Errorf("resizing image %s: %w", image, err)
+		}
+	}
+
+	if err = f.Close(); err != nil {
+		return "", err
+	}
+
+	return loop.Attach(image)
+}
+
+// growImage grows the image file of an attached volume, and makes its loop
+// device pick up the new size
+func growImage(image string, size int64) error {
+	dev, err := loop.Find(image)
+	if err != nil {
+		return err
+	}
+
+	st, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+
+	// images are never shrunk
+	if st.Size() < size {
+		if err = os.Truncate(image, size); err != nil {
+			return fmt.Errorf("resizing image %s: %w", image, err)
+		}
+	}
+
+	if dev == "" {
+		return nil
+	}
+
+	return loop.Resize(dev)
+}
+
+// detachImage releases the loop device of the image file, if any
+func detachImage(image string) error {
+	dev, err := loop.Find(image)
+	if err != nil || dev == "" {
+		return err
+	}
+
+	return loop.Detach(dev)
+}
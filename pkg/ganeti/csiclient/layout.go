@@ -0,0 +1,117 @@
+package csiclient
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
+)
+
+// volumePath returns the directory of the volume on this node, in the
+// subdirectory of the provider. Volumes attached under the former fixed
+// directory stay there until detached, as their mounts cannot be moved.
+// Those of other providers, as recorded by their state, are left alone.
+func (c *client) volumePath(vol *extstorage.VolumeInfo) string {
+	if p, ok := c.paths[vol.UUID]; ok {
+		return p
+	}
+
+	p := path.Join(c.cfg.Attach.Dir, c.cfg.Attach.Provider, vol.UUID)
+	if legacy := path.Join(config.DefaultAttachDir, vol.UUID); legacy != p {
+		if _, err := os.Lstat(path.Join(legacy, "device")); err == nil {
+			if s, err := readState(path.Join(legacy, stateName)); err == nil && (s == nil || s.Provider == "" || s.Provider == c.cfg.Attach.Provider) {
+				slog.Info("volume is attached under the former layout until detached", "path", legacy)
+				p = legacy
+			}
+		}
+	}
+	c.paths[vol.UUID] = p
+
+	return p
+}
+
+func (c *client) devicePath(vol *extstorage.VolumeInfo) string {
+	return path.Join(c.volumePath(vol), "device")
+}
+
+func (c *client) volumeStagingPath(vol *extstorage.VolumeInfo) string {
+	return path.Join(c.volumePath(vol), "staging")
+}
+
+func (c *client) imagePath(vol *extstorage.VolumeInfo) string {
+	return path.Join(c.devicePath(vol), imageName)
+}
+
+// makeVolumePath creates the directory of the volume, and the attach and
+// provider directories above it
+func (c *client) makeVolumePath(vol *extstorage.VolumeInfo) error {
+	volPath := c.volumePath(vol)
+
+	base := c.cfg.Attach.Dir
+	dirs := []string{base}
+	if path.Dir(volPath) != base {
+		dirs = append(dirs, path.Dir(volPath))
+	}
+	if path.Dir(volPath) == config.DefaultAttachDir {
+		// attached under the former layout
+		base = config.DefaultAttachDir
+		dirs = []string{base}
+	}
+	dirs = append(dirs, volPath)
+
+	if err := os.MkdirAll(path.Dir(base), 0o755); err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := makeDir(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// makeDir creates dir unless it exists, then verifies that it is a directory
+// owned by us, not accessible beyond perm. Directories the driver mounted
+// filesystems on are left to it.
+func makeDir(dir string, perm os.FileMode) error {
+	if err := os.Mkdir(dir, perm); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	if parent, err := os.Lstat(path.Dir(dir)); err == nil {
+		if pst, ok := parent.Sys().(*syscall.Stat_t); ok && pst.Dev != st.Dev {
+			// mount point
+			return nil
+		}
+	}
+
+	if fi.Mode().Perm()&^perm != 0 {
+		return fmt.Errorf("%s must not be accessible beyond mode %s, mode is %s", dir, perm, fi.Mode().Perm())
+	}
+
+	if int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s must be owned by uid %d", dir, os.Geteuid())
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package csiclient
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
+)
+
+func (c *client) Open(ctx context.Context, cfg *extstorage.VolumeInfo) error {
+	vol, d, err := c.volume(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	// Volumes created before the access mode was recorded were all
+	// multi-node multi-writer
+	mode := vol.AccessMode
+	if mode == "" {
+		mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER.String()
+	}
+
+	if !cfg.OpenExclusive && !config.Shareable(mode) {
+		return fmt.Errorf("volume %s has access mode %s, which cannot be shared between nodes for migration", cfg.UUID, mode)
+	}
+
+	return c.expandPending(ctx, cfg, vol, d)
+}
+
+func (c *client) CloseVolume(ctx context.Context, cfg *extstorage.VolumeInfo) error {
+	return c.Setinfo(ctx, cfg)
+}
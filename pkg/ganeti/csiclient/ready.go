@@ -0,0 +1,92 @@
+package csiclient
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+)
+
+// readyPollInterval is the delay between checks for readiness
+const readyPollInterval = 500 * time.Millisecond
+
+// waitReady waits for the socket of a unix endpoint to appear, then polls
+// Probe until the service reports to be ready. Both are limited by the
+// ready timeout, the error tells which step is pending.
+func (d *driver) waitReady(ctx context.Context, svc config.Service, kind string) error {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeouts.Ready)
+	defer cancel()
+
+	pending := func(step string, err error) error {
+		if err != nil {
+			step = fmt.Sprintf("%s: %v", step, err)
+		}
+		return fmt.Errorf("%w: %s service of %s within %s, %s", ErrNotReady, kind, d.name, d.cfg.Timeouts.Ready, step)
+	}
+
+	if socket, ok := unixSocket(svc.Endpoint); ok {
+		for logged := false; ; logged = true {
+			_, err := os.Stat(socket)
+			if err == nil {
+				break
+			}
+			if !os.IsNotExist(err) {
+				return err
+			}
+
+			if !logged {
+				slog.InfoContext(ctx, "waiting for CSI socket", "driver", d.name, "service", kind, "socket", socket)
+			}
+			if !sleep(ctx, readyPollInterval) {
+				return pending("socket "+socket+" does not exist", nil)
+			}
+		}
+	}
+
+	conn, err := d.dial(ctx, svc)
+	if err != nil {
+		return err
+	}
+
+	ic := csi.NewIdentityClient(conn)
+	for logged := false; ; logged = true {
+		resp, err := ic.Probe(ctx, &csi.ProbeRequest{})
+		// a missing ready field means ready
+		if err == nil && (resp.Ready == nil || resp.Ready.Value) {
+			return nil
+		}
+
+		if !logged {
+			slog.InfoContext(ctx, "waiting for CSI service to become ready", "driver", d.name, "service", kind)
+		}
+		if !sleep(ctx, readyPollInterval) {
+			return pending("Probe does not report ready", err)
+		}
+	}
+}
+
+// unixSocket returns the socket path of unix endpoints
+func unixSocket(endpoint string) (string, bool) {
+	for _, prefix := range []string{"unix://", "unix:"} {
+		if strings.HasPrefix(endpoint, prefix) {
+			return strings.TrimPrefix(endpoint, prefix), true
+		}
+	}
+
+	return "", false
+}
+
+// sleep waits for d, returning false when ctx is done before
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -3,28 +3,36 @@ package csiclient
 import (
 	"context"
 
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
 )
 
 func (c *client) Remove(ctx context.Context, cfg *extstorage.VolumeInfo) error {
-	if !c.controllerService {
-		return ErrControllerServiceMissing
+	vol, d, err := c.volume(ctx, cfg)
+	if err != nil {
+		return err
 	}
 
-	vol, err := c.store.Get(ctx, cfg.UUID)
+	ctrl, err := d.controllerService(ctx)
 	if err != nil {
 		return err
 	}
 
-	if vol == nil {
-		return ErrVolumeNotFound
+	if !ctrl.caps.ControllerService {
+		return ErrControllerServiceMissing
+	}
+
+	secrets, err := d.operationSecrets(config.SecretsDeleteVolume)
+	if err != nil {
+		return err
 	}
 
-	cont := csi.NewControllerClient(c.conn)
+	cont := csi.NewControllerClient(ctrl.conn)
 
 	_, err = cont.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
 		VolumeId: vol.VolumeId,
+		Secrets:  secrets,
 	})
 
 	if err != nil {
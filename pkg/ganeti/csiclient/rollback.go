@@ -0,0 +1,33 @@
+package csiclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// rollback holds steps undoing completed steps of an operation
+type rollback []func(ctx context.Context) error
+
+// add adds a step, run before steps added earlier
+func (r *rollback) add(step func(ctx context.Context) error) {
+	*r = append(*r, step)
+}
+
+// run undoes completed steps in reverse order after err, and reports
+// failures of the rollback next to err. Steps run even when ctx has expired,
+// limited by timeout.
+func (r rollback) run(ctx context.Context, timeout time.Duration, err error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	errs := []error{err}
+	for i := len(r) - 1; i >= 0; i-- {
+		if rerr := r[i](ctx); rerr != nil {
+			errs = append(errs, fmt.Errorf("rolling back: %w", rerr))
+		}
+	}
+
+	return errors.Join(errs...)
+}
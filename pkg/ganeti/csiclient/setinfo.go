@@ -7,14 +7,8 @@ import (
 )
 
 func (c *client) Setinfo(ctx context.Context, cfg *extstorage.VolumeInfo) error {
-	vol, err := c.store.Get(ctx, cfg.UUID)
-	if err != nil {
-		return err
-	}
+	// metadata only, not depending on the node service
+	_, _, err := c.volume(ctx, cfg)
 
-	if vol == nil {
-		return ErrVolumeNotFound
-	}
-
-	return nil
+	return err
 }
@@ -0,0 +1,156 @@
+package csiclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
+)
+
+const (
+	// stateName is the node-local state file in the volume directory
+	stateName = "attachment.json"
+
+	// detachedDir holds states of volumes detached while the metadata store
+	// was unreachable, until reconciled
+	detachedDir = ".detached"
+)
+
+// attachmentState is the node-local record of an attached volume, letting
+// detach complete while the metadata store is unreachable
+type attachmentState struct {
+	Driver            string            `json:"driver"`
+	VolumeID          string            `json:"volume_id"`
+	NodeID            string            `json:"node_id,omitempty"`
+	PublishContext    map[string]string `json:"publish_context,omitempty"`
+	StagingTargetPath string            `json:"staging_target_path,omitempty"`
+	TargetPath        string            `json:"target_path"`
+	ImageSize         int64             `json:"image_size,omitempty"`
+
+	// ControllerPublished is set when the controller published the volume
+	// to the node, which detach then undoes
+	ControllerPublished bool `json:"controller_published,omitempty"`
+
+	// Provider is the extstorage provider which attached the volume, it
+	// tells the owner of attachments under the former layout
+	Provider string `json:"provider,omitempty"`
+}
+
+// volume returns the parts of the stored volume detach needs
+func (s *attachmentState) volume() *store.Volume {
+	return &store.Volume{
+		Volume:    &csi.Volume{VolumeId: s.VolumeID},
+		Driver:    s.Driver,
+		ImageSize: s.ImageSize,
+	}
+}
+
+func (c *client) statePath(vol *extstorage.VolumeInfo) string {
+	return path.Join(c.volumePath(vol), stateName)
+}
+
+func (c *client) detachedPath(vol *extstorage.VolumeInfo) string {
+	return path.Join(c.cfg.Attach.Dir, c.cfg.Attach.Provider, detachedDir, vol.UUID+".json")
+}
+
+// saveState writes the state of the attached volume
+func (c *client) saveState(vol *extstorage.VolumeInfo, s *attachmentState) error {
+	return writeState(c.statePath(vol), s)
+}
+
+// loadState reads the state of the attached volume, nil if there is none
+func (c *client) loadState(vol *extstorage.VolumeInfo) (*attachmentState, error) {
+	return readState(c.statePath(vol))
+}
+
+// volumeOrState returns the stored volume and its driver. When the store
+// fails, the volume is taken from the node-local state if there is one, and
+// marked for reconciling with the store later.
+func (c *client) volumeOrState(ctx context.Context, cfg *extstorage.VolumeInfo) (*store.Volume, *driver, *attachmentState, error) {
+	s, serr := c.loadState(cfg)
+
+	vol, d, err := c.volume(ctx, cfg)
+	if err == nil {
+		return vol, d, s, nil
+	}
+	if s == nil {
+		return nil, nil, nil, errors.Join(err, serr)
+	}
+
+	slog.Warn("volume unavailable from the metadata store, using node-local state", "error", err)
+
+	if d, err = c.driver(s.Driver); err != nil {
+		return nil, nil, nil, err
+	}
+
+	dir := path.Dir(c.detachedPath(cfg))
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, nil, err
+	}
+	if err = writeState(c.detachedPath(cfg), s); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return s.volume(), d, s, nil
+}
+
+// reconcile checks a volume detached while the store was unreachable
+// against the stored one
+func (c *client) reconcile(cfg *extstorage.VolumeInfo, vol *store.Volume) {
+	file := c.detachedPath(cfg)
+
+	s, err := readState(file)
+	if err != nil || s == nil {
+		return
+	}
+
+	switch {
+	case vol == nil:
+		slog.Warn("volume detached without the metadata store is missing from it", "volume_id", s.VolumeID)
+	case vol.VolumeId != s.VolumeID || vol.Driver != s.Driver:
+		slog.Error("volume detached without the metadata store differs from the stored one",
+			"volume_id", s.VolumeID, "driver", s.Driver,
+			"stored_volume_id", vol.VolumeId, "stored_driver", vol.Driver)
+	default:
+		slog.Info("volume detached without the metadata store reconciled", "volume_id", s.VolumeID)
+	}
+
+	os.Remove(file)
+}
+
+func writeState(file string, s *attachmentState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func readState(file string) (*attachmentState, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s attachmentState
+	if err = json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
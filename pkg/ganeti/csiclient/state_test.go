@@ -0,0 +1,94 @@
+package csiclient
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		data    string
+		want    *attachmentState
+		wantErr bool
+	}{
+		{name: "missing"},
+		{
+			name: "state",
+			data: `{"driver":"rbd","volume_id":"v1","target_path":"/t","image_size":1024,"controller_published":true,"provider":"csi"}`,
+			want: &attachmentState{Driver: "rbd", VolumeID: "v1", TargetPath: "/t", ImageSize: 1024, ControllerPublished: true, Provider: "csi"},
+		},
+		{
+			name: "former state",
+			data: `{"driver":"rbd","volume_id":"v1","target_path":"/t"}`,
+			want: &attachmentState{Driver: "rbd", VolumeID: "v1", TargetPath: "/t"},
+		},
+		{name: "malformed", data: `{"driver":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(dir, tt.name+".json")
+			if tt.data != "" {
+				if err := os.WriteFile(file, []byte(tt.data), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := readState(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readState() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteState(t *testing.T) {
+	file := path.Join(t.TempDir(), stateName)
+
+	s := &attachmentState{
+		Driver:              "rbd",
+		VolumeID:            "v1",
+		NodeID:              "n1",
+		PublishContext:      map[string]string{"k": "v"},
+		StagingTargetPath:   "/s",
+		TargetPath:          "/t",
+		ImageSize:           1024,
+		ControllerPublished: true,
+		Provider:            "csi",
+	}
+	if err := writeState(file, s); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("state mode = %v, want 0600", fi.Mode().Perm())
+	}
+	if _, err = os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary state left behind: %v", err)
+	}
+
+	got, err := readState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("readState() = %+v, want %+v", got, s)
+	}
+
+	vol := got.volume()
+	if vol.VolumeId != "v1" || vol.Driver != "rbd" || vol.ImageSize != 1024 {
+		t.Errorf("volume() = %+v", vol)
+	}
+}
@@ -0,0 +1,120 @@
+package csiclient
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
+)
+
+// TopologyExtParam is the ext-param holding topology segments as
+// key=value pairs separated by commas. Set it on node group level
+// disk parameters to derive topology from the Ganeti node group.
+const TopologyExtParam = "csi_topology"
+
+// parseTopology parses segments given as key=value,key=value
+func parseTopology(s string) (map[string]string, error) {
+	segments := make(map[string]string)
+
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid topology segment %q, expected key=value", kv)
+		}
+		segments[key] = value
+	}
+
+	return segments, nil
+}
+
+// accessibilityRequirements returns requirements for creating a volume.
+// Segments are taken from the driver configuration, overridden by the
+// ext-param. Without either, the topology of the local node is required.
+func (d *driver) accessibilityRequirements(ctx context.Context, cfg *extstorage.VolumeInfo) (*csi.TopologyRequirement, error) {
+	segments := make(map[string]string)
+	for key, value := range d.cfg.Topology {
+		segments[key] = value
+	}
+
+	extSegments, err := parseTopology(cfg.ExtParams[TopologyExtParam])
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range extSegments {
+		segments[key] = value
+	}
+
+	if len(segments) == 0 {
+		ni, err := d.nodeInfo(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("no topology configured, and querying node topology failed: %w", err)
+		}
+		segments = ni.AccessibleTopology
+	}
+
+	if len(segments) == 0 {
+		return nil, nil
+	}
+
+	topology := []*csi.Topology{{Segments: segments}}
+
+	return &csi.TopologyRequirement{
+		Requisite: topology,
+		Preferred: topology,
+	}, nil
+}
+
+// checkTopology refuses volumes not accessible from the local node
+func (d *driver) checkTopology(ctx context.Context, vol *store.Volume) error {
+	if len(vol.AccessibleTopology) == 0 {
+		return nil
+	}
+
+	ni, err := d.nodeInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, topology := range vol.AccessibleTopology {
+		if topologyContains(ni.AccessibleTopology, topology.GetSegments()) {
+			return nil
+		}
+	}
+
+	accessible := make([]string, 0, len(vol.AccessibleTopology))
+	for _, topology := range vol.AccessibleTopology {
+		accessible = append(accessible, formatSegments(topology.GetSegments()))
+	}
+
+	return fmt.Errorf("volume is not accessible from node %s with topology {%s}, it is accessible from: %s",
+		ni.NodeID, formatSegments(ni.AccessibleTopology), strings.Join(accessible, ", "))
+}
+
+// topologyContains reports whether node segments satisfy all required ones
+func topologyContains(node, required map[string]string) bool {
+	for key, value := range required {
+		if node[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func formatSegments(segments map[string]string) string {
+	pairs := make([]string, 0, len(segments))
+	for key, value := range segments {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
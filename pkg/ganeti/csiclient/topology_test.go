@@ -0,0 +1,63 @@
+package csiclient
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTopology(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"zone=a", map[string]string{"zone": "a"}, false},
+		{"zone=a, rack=r1 ,", map[string]string{"zone": "a", "rack": "r1"}, false},
+		{"zone=a,zone=b", map[string]string{"zone": "b"}, false},
+		{"zone=", map[string]string{"zone": ""}, false},
+		{"topology.example.com/zone=a=b", map[string]string{"topology.example.com/zone": "a=b"}, false},
+		{"zone", nil, true},
+		{"=a", nil, true},
+		{"zone=a,rack", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTopology(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTopology(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTopology(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTopologyContains(t *testing.T) {
+	node := map[string]string{"zone": "a", "rack": "r1"}
+
+	tests := []struct {
+		name     string
+		required map[string]string
+		want     bool
+	}{
+		{"nothing required", nil, true},
+		{"subset", map[string]string{"zone": "a"}, true},
+		{"all", map[string]string{"zone": "a", "rack": "r1"}, true},
+		{"other value", map[string]string{"zone": "b"}, false},
+		{"missing key", map[string]string{"region": "eu"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := topologyContains(node, tt.required); got != tt.want {
+			t.Errorf("%s: topologyContains() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFormatSegments(t *testing.T) {
+	if got := formatSegments(map[string]string{"zone": "a", "rack": "r1"}); got != "rack=r1,zone=a" {
+		t.Errorf("formatSegments() = %q", got)
+	}
+}
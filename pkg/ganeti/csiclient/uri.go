@@ -0,0 +1,52 @@
+package csiclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
+)
+
+// printAttachment prints the result of attach: the local block device path
+// in the first line, which is empty for userspace-only access, followed by
+// <hypervisor>:<uri> lines of userspace access URIs
+func printAttachment(dev string, uris []string) {
+	fmt.Println(dev)
+	for _, uri := range uris {
+		fmt.Println(uri)
+	}
+}
+
+// userspaceURIs evaluates the URI templates of the driver
+func (d *driver) userspaceURIs(vol *store.Volume, publishContext map[string]string) ([]string, error) {
+	hypervisors := make([]string, 0, len(d.cfg.URIs))
+	for hypervisor := range d.cfg.URIs {
+		hypervisors = append(hypervisors, hypervisor)
+	}
+	sort.Strings(hypervisors)
+
+	data := &config.URIData{
+		VolumeID:       vol.VolumeId,
+		VolumeContext:  vol.VolumeContext,
+		PublishContext: publishContext,
+	}
+
+	uris := make([]string, 0, len(hypervisors))
+	for _, hypervisor := range hypervisors {
+		tmpl, err := config.ParseURITemplate(hypervisor, d.cfg.URIs[hypervisor])
+		if err != nil {
+			return nil, err
+		}
+
+		var uri strings.Builder
+		if err = tmpl.Execute(&uri, data); err != nil {
+			return nil, fmt.Errorf("evaluating %s uri template: %w", hypervisor, err)
+		}
+
+		uris = append(uris, hypervisor+":"+uri.String())
+	}
+
+	return uris, nil
+}
@@ -2,11 +2,22 @@ package csiclient
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/ganeti/extstorage"
 )
 
 func (c *client) Verify(ctx context.Context, cfg *extstorage.VolumeInfo) error {
+	if name := cfg.ExtParams[DriverExtParam]; name != "" {
+		if _, ok := c.cfg.Drivers[name]; !ok {
+			return fmt.Errorf("unknown CSI driver %q", name)
+		}
+	}
+
+	if _, err := parseTopology(cfg.ExtParams[TopologyExtParam]); err != nil {
+		return err
+	}
+
 	vol, err := c.store.Get(ctx, cfg.UUID)
 	if err != nil {
 		return err
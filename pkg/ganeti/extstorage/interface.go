@@ -69,6 +69,18 @@ type Interface interface {
 	*/
 	Verify(context.Context, *VolumeInfo) error
 
+	/*
+		The open script is used to open the volume for access by the instance. The VOL_OPEN_EXCLUSIVE variable denotes whether the volume will be opened for exclusive access or not; it is False during live migration, when the volume is open on both the source and the target node.
+		The script returns 0 on success.
+	*/
+	Open(context.Context, *VolumeInfo) error
+
+	/*
+		The close script is used to close the volume after the instance stopped accessing it, e.g. on the source node after migration. It undoes everything open did.
+		The script returns 0 on success.
+	*/
+	CloseVolume(context.Context, *VolumeInfo) error
+
 	// Close closes the driver
 	Close(context.Context) error
 }
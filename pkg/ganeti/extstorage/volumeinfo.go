@@ -2,6 +2,8 @@ package extstorage
 
 import (
 	"log"
+	"os"
+	"strings"
 
 	"github.com/codingconcepts/env"
 )
@@ -30,12 +32,12 @@ type VolumeInfo struct {
 	SnapshotSize int64 `env:"VOL_SNAPSHOT_SIZE"`
 	// Whether the volume will be opened for exclusive access or not. This will be False (denoting shared access) during migration.
 	OpenExclusive bool `env:"VOL_OPEN_EXCLUSIVE"`
-	// Truenas CSI NAS selector
-	TrueNASCSINasSelector string `env:"EXTP_TRUENAS_CSI_NAS"`
-	// Truenas-CSI config selector
-	TrueNASCSIConfigSelector string `env:"EXTP_TRUENAS_CSI_CONFIG"`
+	// Ext-params passed by Ganeti as EXTP_<NAME> variables, keyed by lowercase name
+	ExtParams map[string]string
 }
 
+const extParamPrefix = "EXTP_"
+
 // ParseVolumeInfo returns VolumeInfo parsed from environment
 func ParseVolumeInfo() *VolumeInfo {
 	c := &VolumeInfo{}
@@ -44,5 +46,12 @@ func ParseVolumeInfo() *VolumeInfo {
 		log.Fatal(err)
 	}
 
+	c.ExtParams = make(map[string]string)
+	for _, kv := range os.Environ() {
+		if name, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(name, extParamPrefix) {
+			c.ExtParams[strings.ToLower(strings.TrimPrefix(name, extParamPrefix))] = value
+		}
+	}
+
 	return c
 }
@@ -0,0 +1,149 @@
+// Package logging sets up structured logging of ganeti-extstorage-csi
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+)
+
+const syslogTag = "ganeti-extstorage-csi"
+
+// New returns a logger writing to stderr, or to syslog, which is also
+// picked up by journald
+func New(cfg config.Log) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch cfg.Format {
+	case config.LogFormatText:
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case config.LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	case config.LogFormatSyslog:
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, syslogTag)
+		if err != nil {
+			return nil, err
+		}
+
+		return slog.New(newSyslogHandler(w, opts)), nil
+	}
+
+	return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+}
+
+// CorrelationID returns a random identifier tying together the log lines
+// of an operation
+func CorrelationID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// syslogHandler formats records as text, and writes them with the syslog
+// priority matching their level
+type syslogHandler struct {
+	w *syslog.Writer
+	h slog.Handler
+
+	// buffer the text handler writes to, shared by derived handlers
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func newSyslogHandler(w *syslog.Writer, opts *slog.HandlerOptions) *syslogHandler {
+	buf := &bytes.Buffer{}
+
+	return &syslogHandler{
+		w: w,
+		h: slog.NewTextHandler(buf, &slog.HandlerOptions{
+			Level: opts.Level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// syslog records time and level itself
+				if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+		mu:  &sync.Mutex{},
+		buf: buf,
+	}
+}
+
+func (s *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.h.Enabled(ctx, level)
+}
+
+func (s *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf.Reset()
+	if err := s.h.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := s.buf.String()
+
+	switch {
+	case r.Level >= slog.LevelError:
+		return s.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return s.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return s.w.Info(msg)
+	}
+
+	return s.w.Debug(msg)
+}
+
+func (s *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{w: s.w, h: s.h.WithAttrs(attrs), mu: s.mu, buf: s.buf}
+}
+
+func (s *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{w: s.w, h: s.h.WithGroup(name), mu: s.mu, buf: s.buf}
+}
+
+// UnaryClientInterceptor logs gRPC calls with their duration and status.
+// Requests are not logged, as they may carry secrets.
+func UnaryClientInterceptor(component string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+
+		level := slog.LevelInfo
+		attrs := []any{
+			"component", component,
+			"method", method,
+			"duration", time.Since(start),
+			"status", status.Code(err).String(),
+		}
+		if err != nil {
+			level = slog.LevelError
+			attrs = append(attrs, "error", status.Convert(err).Message())
+		}
+		slog.Log(ctx, level, "gRPC call", attrs...)
+
+		return err
+	}
+}
@@ -0,0 +1,140 @@
+// Package loop manages loop devices backed by image files
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	loopControl = "/dev/loop-control"
+	sysBlock    = "/sys/block"
+
+	// attempts to grab a free loop device racing with others
+	setupAttempts = 8
+)
+
+// Find returns the loop device backed by file, or "" when there is none
+func Find(file string) (string, error) {
+	backingFiles, err := filepath.Glob(path.Join(sysBlock, "loop*", "loop", "backing_file"))
+	if err != nil {
+		return "", err
+	}
+
+	file = filepath.Clean(file)
+	for _, backingFile := range backingFiles {
+		data, err := os.ReadFile(backingFile)
+		if err != nil {
+			// device detached meanwhile
+			continue
+		}
+
+		if strings.TrimSpace(string(data)) == file {
+			return path.Join("/dev", path.Base(path.Dir(path.Dir(backingFile)))), nil
+		}
+	}
+
+	return "", nil
+}
+
+// Attach returns a loop device backed by file, setting one up unless it
+// already exists. The device does direct I/O, bypassing the page cache, as
+// the file may be shared by nodes, e.g. during live migration.
+func Attach(file string) (string, error) {
+	if dev, err := Find(file); err != nil || dev != "" {
+		if err == nil {
+			// devices set up by earlier versions did buffered I/O
+			err = setDirectIO(dev)
+		}
+		return dev, err
+	}
+
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	ctl, err := os.OpenFile(loopControl, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer ctl.Close()
+
+	for i := 0; i < setupAttempts; i++ {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", fmt.Errorf("getting free loop device: %w", err)
+		}
+
+		dev := fmt.Sprintf("/dev/loop%d", n)
+		lf, err := os.OpenFile(dev, os.O_RDWR, 0)
+		if err != nil {
+			return "", err
+		}
+
+		err = unix.IoctlSetInt(int(lf.Fd()), unix.LOOP_SET_FD, int(f.Fd()))
+		lf.Close()
+
+		if errors.Is(err, unix.EBUSY) {
+			// grabbed by someone else meanwhile
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("setting up %s: %w", dev, err)
+		}
+
+		if err = setDirectIO(dev); err != nil {
+			return "", errors.Join(err, Detach(dev))
+		}
+
+		return dev, nil
+	}
+
+	return "", errors.New("no free loop device could be set up")
+}
+
+// Detach releases a loop device
+func Detach(dev string) error {
+	return ioctl(dev, unix.LOOP_CLR_FD)
+}
+
+// Resize makes a loop device pick up the size of its backing file
+func Resize(dev string) error {
+	return ioctl(dev, unix.LOOP_SET_CAPACITY)
+}
+
+// setDirectIO enables direct I/O of a loop device
+func setDirectIO(dev string) error {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = unix.IoctlSetInt(int(f.Fd()), unix.LOOP_SET_DIRECT_IO, 1); err != nil {
+		return fmt.Errorf("enabling direct I/O of %s, the image filesystem must support it: %w", dev, err)
+	}
+
+	return nil
+}
+
+func ioctl(dev string, req uint) error {
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = unix.IoctlSetInt(int(f.Fd()), req, 0); err != nil {
+		return fmt.Errorf("%s: %w", dev, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// Package metrics records Prometheus metrics of ganeti-extstorage-csi runs.
+// As each run is a short-lived process, observations are merged into a
+// state file and exposed via the textfile collector of node_exporter.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "ganeti_extstorage_csi"
+
+// Metric names
+const (
+	OperationsTotal   = namespace + "_operations_total"
+	OperationDuration = namespace + "_operation_duration_seconds"
+	RPCDuration       = namespace + "_csi_rpc_duration_seconds"
+	StoreDuration     = namespace + "_store_duration_seconds"
+)
+
+// Results of operations and store calls
+const (
+	ResultOK      = "ok"
+	ResultError   = "error"
+	ResultTimeout = "timeout"
+)
+
+var help = map[string]string{
+	OperationsTotal:   "Number of extstorage operations by result",
+	OperationDuration: "Duration of extstorage operations",
+	RPCDuration:       "Duration of CSI gRPC calls by status code",
+	StoreDuration:     "Duration of metadata store calls",
+}
+
+// buckets of latency histograms, in seconds
+var buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// series is a counter or histogram with a set of label values
+type series struct {
+	Name string `json:"name"`
+	// Labels are formatted label pairs, without braces
+	Labels string `json:"labels"`
+
+	// Value of counters
+	Value float64 `json:"value,omitempty"`
+
+	// Buckets hold non-cumulative counts of histograms, the last one
+	// counts observations above all bounds
+	Buckets []uint64 `json:"buckets,omitempty"`
+	Count   uint64   `json:"count,omitempty"`
+	Sum     float64  `json:"sum,omitempty"`
+}
+
+func (s *series) key() string {
+	return s.Name + "{" + s.Labels + "}"
+}
+
+// observations of the current run
+var (
+	mu       sync.Mutex
+	observed = make(map[string]*series)
+)
+
+func get(name string, labels ...string) *series {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+
+	s := &series{Name: name, Labels: strings.Join(pairs, ",")}
+	if existing, ok := observed[s.key()]; ok {
+		return existing
+	}
+	observed[s.key()] = s
+
+	return s
+}
+
+func (s *series) observe(d time.Duration) {
+	if s.Buckets == nil {
+		s.Buckets = make([]uint64, len(buckets)+1)
+	}
+
+	v := d.Seconds()
+	s.Buckets[sort.SearchFloat64s(buckets, v)]++
+	s.Count++
+	s.Sum += v
+}
+
+// ObserveOperation records an extstorage operation
+func ObserveOperation(operation, result string, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	get(OperationsTotal, "operation", operation, "result", result).Value++
+	get(OperationDuration, "operation", operation, "result", result).observe(d)
+}
+
+// ObserveRPC records a CSI call
+func ObserveRPC(method, code string, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	get(RPCDuration, "method", method, "code", code).observe(d)
+}
+
+// ObserveStore records a metadata store call
+func ObserveStore(store, op, result string, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	get(StoreDuration, "store", store, "op", op, "result", result).observe(d)
+}
+
+// UnaryClientInterceptor records the latency of CSI calls
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		ObserveRPC(method, status.Code(err).String(), time.Since(start))
+
+		return err
+	}
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const stateSuffix = ".state"
+
+// Flush merges observations of this run into the state kept next to file,
+// and atomically rewrites file in the Prometheus text format. Concurrent
+// runs are serialized by locking the state file.
+func Flush(file string) error {
+	if file == "" {
+		return nil
+	}
+
+	state, err := os.OpenFile(file+stateSuffix, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	if err = unix.Flock(int(state.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+
+	// An unreadable state resets metrics, which Prometheus handles as a
+	// counter reset
+	all := make(map[string]*series)
+	if data, err := io.ReadAll(state); err == nil && len(data) > 0 {
+		if err = json.Unmarshal(data, &all); err != nil {
+			all = make(map[string]*series)
+		}
+	}
+
+	mu.Lock()
+	for key, s := range observed {
+		merge(all, key, s)
+	}
+	observed = make(map[string]*series)
+	mu.Unlock()
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if err = state.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = state.WriteAt(data, 0); err != nil {
+		return err
+	}
+
+	return writeTextfile(file, all)
+}
+
+func merge(all map[string]*series, key string, s *series) {
+	existing, ok := all[key]
+	if !ok || len(existing.Buckets) != len(s.Buckets) {
+		all[key] = s
+		return
+	}
+
+	existing.Value += s.Value
+	for i := range s.Buckets {
+		existing.Buckets[i] += s.Buckets[i]
+	}
+	existing.Count += s.Count
+	existing.Sum += s.Sum
+}
+
+// writeTextfile writes a temporary file not matching *.prom, then renames
+// it, so node_exporter never reads a partial file
+func writeTextfile(file string, all map[string]*series) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.WriteString(tmp, format(all)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// format returns series in the Prometheus text format, grouped by name
+func format(all map[string]*series) string {
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	var name string
+
+	for _, key := range keys {
+		s := all[key]
+
+		if s.Name != name {
+			name = s.Name
+			kind := "counter"
+			if s.Buckets != nil {
+				kind = "histogram"
+			}
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help[name], name, kind)
+		}
+
+		if s.Buckets == nil {
+			fmt.Fprintf(&b, "%s{%s} %s\n", s.Name, s.Labels, formatFloat(s.Value))
+			continue
+		}
+
+		labels := s.Labels
+		if labels != "" {
+			labels += ","
+		}
+
+		var cumulative uint64
+		for i, count := range s.Buckets {
+			cumulative += count
+			le := "+Inf"
+			if i < len(buckets) {
+				le = formatFloat(buckets[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{%sle=%q} %d\n", s.Name, labels, le, cumulative)
+		}
+		fmt.Fprintf(&b, "%s_sum{%s} %s\n", s.Name, s.Labels, formatFloat(s.Sum))
+		fmt.Fprintf(&b, "%s_count{%s} %d\n", s.Name, s.Labels, s.Count)
+	}
+
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	histogram := make([]uint64, len(buckets)+1)
+	histogram[0] = 1
+	histogram[len(buckets)] = 2
+
+	tests := []struct {
+		name string
+		all  map[string]*series
+		want []string
+	}{
+		{
+			name: "counter",
+			all: map[string]*series{
+				"a": {Name: OperationsTotal, Labels: `operation="attach",result="ok"`, Value: 3},
+				"b": {Name: OperationsTotal, Labels: `operation="detach",result="error"`, Value: 1},
+			},
+			want: []string{
+				"# HELP " + OperationsTotal + " " + help[OperationsTotal],
+				"# TYPE " + OperationsTotal + " counter",
+				OperationsTotal + `{operation="attach",result="ok"} 3`,
+				OperationsTotal + `{operation="detach",result="error"} 1`,
+			},
+		},
+		{
+			name: "histogram",
+			all: map[string]*series{
+				"a": {Name: RPCDuration, Labels: `method="Probe",code="OK"`, Buckets: histogram, Count: 3, Sum: 120.5},
+			},
+			want: []string{
+				"# TYPE " + RPCDuration + " histogram",
+				RPCDuration + `_bucket{method="Probe",code="OK",le="0.005"} 1`,
+				RPCDuration + `_bucket{method="Probe",code="OK",le="60"} 1`,
+				RPCDuration + `_bucket{method="Probe",code="OK",le="+Inf"} 3`,
+				RPCDuration + `_sum{method="Probe",code="OK"} 120.5`,
+				RPCDuration + `_count{method="Probe",code="OK"} 3`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := format(tt.all)
+			for _, line := range tt.want {
+				if !strings.Contains(got, line+"\n") {
+					t.Errorf("format() lacks %q:\n%s", line, got)
+				}
+			}
+			if n := strings.Count(got, "# TYPE"); n != 1 {
+				t.Errorf("format() has %d TYPE lines, want 1:\n%s", n, got)
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	file := path.Join(t.TempDir(), "csi.prom")
+
+	ObserveOperation("attach", ResultOK, 20*time.Millisecond)
+	if err := Flush(file); err != nil {
+		t.Fatal(err)
+	}
+
+	ObserveOperation("attach", ResultOK, 2*time.Minute)
+	ObserveOperation("attach", ResultTimeout, time.Minute)
+	if err := Flush(file); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		OperationsTotal + `{operation="attach",result="ok"} 2`,
+		OperationsTotal + `{operation="attach",result="timeout"} 1`,
+		OperationDuration + `_bucket{operation="attach",result="ok",le="0.025"} 1`,
+		OperationDuration + `_bucket{operation="attach",result="ok",le="+Inf"} 2`,
+		OperationDuration + `_count{operation="attach",result="ok"} 2`,
+	} {
+		if !strings.Contains(string(data), line+"\n") {
+			t.Errorf("textfile lacks %q:\n%s", line, data)
+		}
+	}
+
+	// an unreadable state resets metrics
+	if err = os.WriteFile(file+stateSuffix, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ObserveOperation("detach", ResultOK, time.Second)
+	if err = Flush(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err = os.ReadFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `operation="attach"`) || !strings.Contains(string(data), `operation="detach"`) {
+		t.Errorf("textfile after reset:\n%s", data)
+	}
+
+	if err = Flush(""); err != nil {
+		t.Errorf("Flush() without a file = %v", err)
+	}
+}
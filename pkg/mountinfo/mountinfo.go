@@ -0,0 +1,102 @@
+// Package mountinfo reads the mounts of the process
+package mountinfo
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const file = "/proc/self/mountinfo"
+
+// Mount is a line of mountinfo
+type Mount struct {
+	// Root is the root of the mount within its filesystem
+	Root string
+	// MountPoint is where the filesystem is mounted
+	MountPoint string
+	// FsType is the filesystem type
+	FsType string
+	// Source is the mounted device or resource
+	Source string
+}
+
+// Read returns the mounts of the process
+func Read() ([]Mount, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []Mount
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m, err := parse(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		mounts = append(mounts, m)
+	}
+
+	return mounts, scanner.Err()
+}
+
+// Under returns the mounts at dir or below it
+func Under(mounts []Mount, dir string) (under []Mount) {
+	for _, m := range mounts {
+		if m.MountPoint == dir || strings.HasPrefix(m.MountPoint, dir+"/") {
+			under = append(under, m)
+		}
+	}
+
+	return
+}
+
+// parse parses a line like
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parse(line string) (Mount, error) {
+	fields := strings.Fields(line)
+
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || len(fields) < sep+3 {
+		return Mount{}, fmt.Errorf("malformed line %q", line)
+	}
+
+	return Mount{
+		Root:       unescape(fields[3]),
+		MountPoint: unescape(fields[4]),
+		FsType:     fields[sep+1],
+		Source:     unescape(fields[sep+2]),
+	}, nil
+}
+
+// unescape decodes octal escapes of spaces, tabs, newlines and backslashes
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
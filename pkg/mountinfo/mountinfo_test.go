@@ -0,0 +1,97 @@
+package mountinfo
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Mount
+		wantErr bool
+	}{
+		{
+			name: "optional field",
+			line: `36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue`,
+			want: Mount{Root: "/mnt1", MountPoint: "/mnt2", FsType: "ext3", Source: "/dev/root"},
+		},
+		{
+			name: "no optional fields",
+			line: `25 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw`,
+			want: Mount{Root: "/", MountPoint: "/", FsType: "ext4", Source: "/dev/sda1"},
+		},
+		{
+			name: "several optional fields",
+			line: `40 25 0:35 / /srv/vol rw shared:12 master:3 propagate_from:2 - nfs srv:/export rw`,
+			want: Mount{Root: "/", MountPoint: "/srv/vol", FsType: "nfs", Source: "srv:/export"},
+		},
+		{
+			name: "octal escapes",
+			line: `41 25 0:36 /a\134b /srv/my\040vol\011x rw - fuse my\012src rw`,
+			want: Mount{Root: `/a\b`, MountPoint: "/srv/my vol\tx", FsType: "fuse", Source: "my\nsrc"},
+		},
+		{
+			name:    "missing separator",
+			line:    `36 35 98:0 /mnt1 /mnt2 rw,noatime ext3 /dev/root rw`,
+			wantErr: true,
+		},
+		{
+			name:    "missing source",
+			line:    `36 35 98:0 /mnt1 /mnt2 rw,noatime - ext3`,
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			line:    ``,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parse(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`/plain`, `/plain`},
+		{`a\040b`, `a b`},
+		{`\011\012\134`, "\t\n\\"},
+		{`end\040`, `end `},
+		// incomplete or invalid escapes are kept
+		{`end\04`, `end\04`},
+		{`a\x41b`, `a\x41b`},
+		{`a\999b`, `a\999b`},
+		{`trailing\`, `trailing\`},
+	}
+
+	for _, tt := range tests {
+		if got := unescape(tt.in); got != tt.want {
+			t.Errorf("unescape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUnder(t *testing.T) {
+	mounts := []Mount{
+		{MountPoint: "/srv/a"},
+		{MountPoint: "/srv/a/device"},
+		{MountPoint: "/srv/ab"},
+		{MountPoint: "/srv"},
+	}
+
+	got := Under(mounts, "/srv/a")
+	if len(got) != 2 || got[0].MountPoint != "/srv/a" || got[1].MountPoint != "/srv/a/device" {
+		t.Errorf("Under() = %+v", got)
+	}
+}
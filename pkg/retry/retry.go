@@ -0,0 +1,66 @@
+// Package retry retries calls failing with transient gRPC errors
+package retry
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+)
+
+// Do calls fn until it succeeds, fails with an error the policy does not
+// retry, or attempts or budget are exhausted. Delays grow exponentially,
+// with full jitter.
+func Do(ctx context.Context, method string, p config.RetryPolicy, fn func(context.Context) error) error {
+	start := time.Now()
+	backoff := p.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		code := status.Code(err)
+		if !p.Retryable(code) {
+			return err
+		}
+
+		delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+		if time.Since(start)+delay > p.Budget {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		slog.WarnContext(ctx, "retrying call", "method", method, "attempt", attempt, "status", code.String(), "delay", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// UnaryClientInterceptor retries CSI calls by the policy of their method
+func UnaryClientInterceptor(cfg *config.Retry) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		name := path.Base(method)
+
+		return Do(ctx, name, cfg.Policy(name), func(ctx context.Context) error {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		})
+	}
+}
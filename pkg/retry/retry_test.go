@@ -0,0 +1,150 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+)
+
+func TestDo(t *testing.T) {
+	policy := config.RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Budget:         time.Minute,
+		Codes:          []string{"Unavailable"},
+	}
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+
+	tests := []struct {
+		name    string
+		policy  func(p *config.RetryPolicy)
+		timeout time.Duration
+		// errs are returned by consecutive calls, nil after them
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:      "success",
+			wantCalls: 1,
+		},
+		{
+			name:      "retryable",
+			errs:      []error{unavailable, unavailable},
+			wantCalls: 3,
+		},
+		{
+			name:      "not retryable",
+			errs:      []error{status.Error(codes.NotFound, "not found")},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "not a status",
+			errs:      []error{errors.New("failed")},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "attempts exhausted",
+			errs:      []error{unavailable, unavailable, unavailable, unavailable, unavailable},
+			wantCalls: 4,
+			wantErr:   true,
+		},
+		{
+			name:      "retries disabled",
+			policy:    func(p *config.RetryPolicy) { p.MaxAttempts = 1 },
+			errs:      []error{unavailable},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name: "budget exhausted",
+			policy: func(p *config.RetryPolicy) {
+				p.InitialBackoff = time.Hour
+				p.MaxBackoff = time.Hour
+				p.Budget = time.Nanosecond
+			},
+			errs:      []error{unavailable, unavailable},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			// delays up to an hour hardly fit before the deadline
+			name: "deadline reached",
+			policy: func(p *config.RetryPolicy) {
+				p.InitialBackoff = time.Hour
+				p.MaxBackoff = time.Hour
+				p.Budget = 2 * time.Hour
+			},
+			timeout:   time.Millisecond,
+			errs:      []error{unavailable, unavailable},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := policy
+			if tt.policy != nil {
+				tt.policy(&p)
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			calls := 0
+			start := time.Now()
+			err := Do(ctx, "Test", p, func(context.Context) error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Do() made %d calls, want %d", calls, tt.wantCalls)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("Do() took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := Do(ctx, "Test", config.RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Budget:         time.Minute,
+		Codes:          []string{"Unavailable"},
+	}, func(context.Context) error {
+		calls++
+		return status.Error(codes.Unavailable, "unavailable")
+	})
+
+	if err == nil || calls != 1 {
+		t.Errorf("Do() = %v after %d calls, want an error after 1", err, calls)
+	}
+}
@@ -12,8 +12,8 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
-	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/tracing"
 )
 
 const (
@@ -29,7 +29,8 @@ func New(endpoint string, tlsConfig *tls.Config) (store.Store, error) {
 		opts = grpc.WithInsecure()
 	}
 
-	conn, err := grpc.Dial(endpoint, opts)
+	// calls are logged by the store wrapper, see store.WithLogging
+	conn, err := grpc.Dial(endpoint, opts, tracing.DialOption())
 	if err != nil {
 		return nil, err
 	}
@@ -45,7 +46,7 @@ type etcd struct {
 	kv   v3.KVClient
 }
 
-func (s *etcd) Add(ctx context.Context, name string, vol *csi.Volume) error {
+func (s *etcd) Add(ctx context.Context, name string, vol *store.Volume) error {
 	data, err := json.Marshal(vol)
 	if err != nil {
 		return err
@@ -85,7 +86,7 @@ func (s *etcd) Add(ctx context.Context, name string, vol *csi.Volume) error {
 	return err
 }
 
-func (s *etcd) Get(ctx context.Context, name string) (*csi.Volume, error) {
+func (s *etcd) Get(ctx context.Context, name string) (*store.Volume, error) {
 	resp, err := s.kv.Range(ctx, &v3.RangeRequest{
 		Key: keyFromVol(name),
 	})
@@ -98,15 +99,68 @@ func (s *etcd) Get(ctx context.Context, name string) (*csi.Volume, error) {
 		return nil, nil
 	}
 
-	var vol csi.Volume
+	var vol store.Volume
 
 	if err = json.Unmarshal(resp.Kvs[0].Value, &vol); err != nil {
 		return nil, err
 	}
+	vol.Revision = resp.Kvs[0].ModRevision
 
 	return &vol, nil
 }
 
+func (s *etcd) Update(ctx context.Context, name string, vol *store.Volume) error {
+	data, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+
+	key := keyFromVol(name)
+
+	compare := &v3.Compare{
+		Key:         key,
+		Target:      v3.Compare_CREATE,
+		Result:      v3.Compare_GREATER,
+		TargetUnion: &v3.Compare_CreateRevision{CreateRevision: 0},
+	}
+	if vol.Revision > 0 {
+		compare = &v3.Compare{
+			Key:         key,
+			Target:      v3.Compare_MOD,
+			Result:      v3.Compare_EQUAL,
+			TargetUnion: &v3.Compare_ModRevision{ModRevision: vol.Revision},
+		}
+	}
+
+	resp, err := s.kv.Txn(ctx, &v3.TxnRequest{
+		Compare: []*v3.Compare{compare},
+		Success: []*v3.RequestOp{
+			{
+				Request: &v3.RequestOp_RequestPut{
+					RequestPut: &v3.PutRequest{
+						Key:   key,
+						Value: data,
+					},
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !resp.Succeeded {
+		if vol.Revision > 0 {
+			return store.ErrConflict
+		}
+		return store.ErrNotFound
+	}
+	vol.Revision = resp.Header.GetRevision()
+
+	return nil
+}
+
 func (s *etcd) Remove(ctx context.Context, name string) error {
 	_, err := s.kv.DeleteRange(ctx, &v3.DeleteRangeRequest{
 		Key: keyFromVol(name),
@@ -9,7 +9,6 @@ import (
 	"os"
 	"path"
 
-	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/store"
 )
 
@@ -32,7 +31,7 @@ func (s *file) path(name string) string {
 	return path.Join(s.base, name)
 }
 
-func (s *file) Add(ctx context.Context, name string, vol *csi.Volume) error {
+func (s *file) Add(ctx context.Context, name string, vol *store.Volume) error {
 	metadatapath := s.path(name)
 
 	if _, err := os.Stat(metadatapath); err == nil || !os.IsNotExist(err) {
@@ -47,7 +46,7 @@ func (s *file) Add(ctx context.Context, name string, vol *csi.Volume) error {
 	return ioutil.WriteFile(metadatapath, data, 0o640)
 }
 
-func (s *file) Get(ctx context.Context, name string) (*csi.Volume, error) {
+func (s *file) Get(ctx context.Context, name string) (*store.Volume, error) {
 	metadatapath := s.path(name)
 
 	data, err := ioutil.ReadFile(metadatapath)
@@ -59,14 +58,51 @@ func (s *file) Get(ctx context.Context, name string) (*csi.Volume, error) {
 		return nil, err
 	}
 
-	var vol csi.Volume
+	var vol store.Volume
 	if err = json.Unmarshal(data, &vol); err != nil {
 		return nil, err
 	}
 
+	// modification times stand for revisions, without locking
+	if st, err := os.Stat(metadatapath); err == nil {
+		vol.Revision = st.ModTime().UnixNano()
+	}
+
 	return &vol, nil
 }
 
+func (s *file) Update(ctx context.Context, name string, vol *store.Volume) error {
+	metadatapath := s.path(name)
+
+	st, err := os.Stat(metadatapath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store.ErrNotFound
+		}
+
+		return err
+	}
+
+	if vol.Revision > 0 && st.ModTime().UnixNano() != vol.Revision {
+		return store.ErrConflict
+	}
+
+	data, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(metadatapath, data, 0o640); err != nil {
+		return err
+	}
+
+	if st, err = os.Stat(metadatapath); err == nil {
+		vol.Revision = st.ModTime().UnixNano()
+	}
+
+	return nil
+}
+
 func (s *file) Remove(ctx context.Context, name string) error {
 	metadatapath := s.path(name)
 
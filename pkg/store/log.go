@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/metrics"
+)
+
+// WithLogging returns a Store logging each call of s with its duration, also
+// recorded as a metric
+func WithLogging(s Store, kind string) Store {
+	return &logged{s: s, kind: kind}
+}
+
+type logged struct {
+	s    Store
+	kind string
+}
+
+func (l *logged) log(ctx context.Context, op, name string, start time.Time, err error) {
+	duration := time.Since(start)
+
+	level := slog.LevelInfo
+	result := metrics.ResultOK
+	attrs := []any{
+		"store", l.kind,
+		"op", op,
+		"key", name,
+		"duration", duration,
+	}
+	if err != nil {
+		level = slog.LevelError
+		result = metrics.ResultError
+		attrs = append(attrs, "error", err)
+	}
+
+	slog.Log(ctx, level, "store call", attrs...)
+	metrics.ObserveStore(l.kind, op, result, duration)
+}
+
+func (l *logged) Add(ctx context.Context, name string, vol *Volume) error {
+	start := time.Now()
+	err := l.s.Add(ctx, name, vol)
+	l.log(ctx, "add", name, start, err)
+
+	return err
+}
+
+func (l *logged) Get(ctx context.Context, name string) (*Volume, error) {
+	start := time.Now()
+	vol, err := l.s.Get(ctx, name)
+	l.log(ctx, "get", name, start, err)
+
+	return vol, err
+}
+
+func (l *logged) Update(ctx context.Context, name string, vol *Volume) error {
+	start := time.Now()
+	err := l.s.Update(ctx, name, vol)
+	l.log(ctx, "update", name, start, err)
+
+	return err
+}
+
+func (l *logged) Remove(ctx context.Context, name string) error {
+	start := time.Now()
+	err := l.s.Remove(ctx, name)
+	l.log(ctx, "remove", name, start, err)
+
+	return err
+}
+
+func (l *logged) Close(ctx context.Context) error {
+	return l.s.Close(ctx)
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"context"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/retry"
+)
+
+// WithRetry returns a Store retrying calls of s by their policy
+func WithRetry(s Store, cfg *config.Retry) Store {
+	return &retried{s: s, cfg: cfg}
+}
+
+type retried struct {
+	s   Store
+	cfg *config.Retry
+}
+
+func (r *retried) do(ctx context.Context, method string, fn func(context.Context) error) error {
+	return retry.Do(ctx, method, r.cfg.Policy(method), fn)
+}
+
+func (r *retried) Add(ctx context.Context, name string, vol *Volume) error {
+	return r.do(ctx, config.RetryStoreAdd, func(ctx context.Context) error {
+		return r.s.Add(ctx, name, vol)
+	})
+}
+
+func (r *retried) Get(ctx context.Context, name string) (vol *Volume, err error) {
+	err = r.do(ctx, config.RetryStoreGet, func(ctx context.Context) error {
+		vol, err = r.s.Get(ctx, name)
+		return err
+	})
+
+	return
+}
+
+func (r *retried) Update(ctx context.Context, name string, vol *Volume) error {
+	return r.do(ctx, config.RetryStoreUpdate, func(ctx context.Context) error {
+		return r.s.Update(ctx, name, vol)
+	})
+}
+
+func (r *retried) Remove(ctx context.Context, name string) error {
+	return r.do(ctx, config.RetryStoreRemove, func(ctx context.Context) error {
+		return r.s.Remove(ctx, name)
+	})
+}
+
+func (r *retried) Close(ctx context.Context) error {
+	return r.s.Close(ctx)
+}
@@ -2,14 +2,60 @@ package store
 
 import (
 	"context"
+	"errors"
 
 	"github.com/dravanet/ganeti-extstorage-csi/pkg/csi"
 )
 
+// Common errors
+var (
+	// ErrNotFound is returned when updating a missing volume
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when updating a volume modified since it has
+	// been read
+	ErrConflict = errors.New("modified concurrently")
+)
+
 // Store provides a Store where the plugin will store metadata from CSI
 type Store interface {
-	Add(ctx context.Context, name string, vol *csi.Volume) error
-	Get(ctx context.Context, name string) (*csi.Volume, error)
+	Add(ctx context.Context, name string, vol *Volume) error
+	Get(ctx context.Context, name string) (*Volume, error)
+	Update(ctx context.Context, name string, vol *Volume) error
 	Remove(ctx context.Context, name string) error
 	Close(ctx context.Context) error
 }
+
+// Volume is the metadata stored for a volume. The CSI volume is embedded,
+// so records written before other fields existed remain readable.
+type Volume struct {
+	*csi.Volume
+
+	// Driver is the name of the configured CSI driver serving the volume.
+	// Empty means the default driver.
+	Driver string `json:"driver,omitempty"`
+
+	// AccessMode is the CSI access mode the volume has been created with.
+	// Empty means MULTI_NODE_MULTI_WRITER, the only mode used before.
+	AccessMode string `json:"access_mode,omitempty"`
+
+	// ImageSize is the size of the image file in bytes, when the volume is a
+	// filesystem holding a loop-backed image file
+	ImageSize int64 `json:"image_size,omitempty"`
+
+	// NodeExpansion is pending when the controller required expanding the
+	// volume on nodes it is attached to
+	NodeExpansion *NodeExpansion `json:"node_expansion,omitempty"`
+
+	// Revision is the revision of the record the volume has been read at,
+	// Update fails with ErrConflict when the record changed since. Zero
+	// skips the check.
+	Revision int64 `json:"-"`
+}
+
+// NodeExpansion records the progress of a node expansion
+type NodeExpansion struct {
+	// CapacityBytes is the capacity the volume has been expanded to
+	CapacityBytes int64 `json:"capacity_bytes"`
+	// Nodes are the CSI node IDs of nodes which carried out the expansion
+	Nodes []string `json:"nodes,omitempty"`
+}
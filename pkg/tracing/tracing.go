@@ -0,0 +1,111 @@
+// Package tracing sets up OpenTelemetry tracing of ganeti-extstorage-csi
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+
+	"github.com/dravanet/ganeti-extstorage-csi/pkg/config"
+)
+
+const name = "ganeti-extstorage-csi"
+
+// Span attributes
+const (
+	VolumeUUID = attribute.Key("ganeti.volume.uuid")
+	VolumeName = attribute.Key("ganeti.volume.name")
+)
+
+// Setup installs the global tracer provider. Without an exporter, tracing
+// stays disabled. The returned function flushes and stops tracing.
+func Setup(ctx context.Context, cfg config.Tracing) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	// f is the trace file of the file exporter
+	var f *os.File
+
+	switch cfg.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case config.TracingExporterOTLP:
+		exporter, err = otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpoint(cfg.Endpoint),
+			otlptracegrpc.WithInsecure(),
+		)
+	case config.TracingExporterFile:
+		f, err = os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err == nil {
+			if exporter, err = stdouttrace.New(stdouttrace.WithWriter(f)); err != nil {
+				f.Close()
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	res := resource.NewSchemaless(
+		semconv.ServiceName(name),
+		semconv.HostName(hostname),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if f == nil {
+		return provider.Shutdown, nil
+	}
+
+	// the file is closed once shutdown flushed the spans into it
+	return func(ctx context.Context) error {
+		return errors.Join(provider.Shutdown(ctx), f.Close())
+	}, nil
+}
+
+// Start starts the root span of an extstorage operation
+func Start(ctx context.Context, operation string) (context.Context, trace.Span) {
+	hostname, _ := os.Hostname()
+
+	return otel.Tracer(name).Start(ctx, "extstorage "+operation,
+		trace.WithAttributes(
+			attribute.String("ganeti.operation", operation),
+			semconv.HostName(hostname),
+		),
+	)
+}
+
+// End ends span, recording err
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// DialOption traces calls of a gRPC client connection
+func DialOption() grpc.DialOption {
+	return grpc.WithStatsHandler(otelgrpc.NewClientHandler())
+}